@@ -0,0 +1,156 @@
+// Backend
+// A backend decides how pod traffic reaches the pod subnet of another node.
+// host-gw routes it natively to the node IP, which requires every node to share an L2 segment,
+// vxlan and ipip encapsulate it so that the nodes only need to reach each other by IP.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	backendHostGW = "host-gw"
+	backendVXLAN  = "vxlan"
+	backendIPIP   = "ipip"
+	// wireguard encrypts pod traffic between nodes
+	backendWireguard = "wireguard"
+)
+
+type backend interface {
+	// overhead is what the backend adds to every packet, the pod mtu is reduced by it
+	overhead() int
+	// setup prepares the current node before any peer is added
+	setup(node *corev1.Node, mtu int) error
+	// routeLinks are the links the routes to the peers go through
+	routeLinks() []netlink.Link
+	// refresh reads the state of the backend's devices at the start of every reconcile,
+	// peerRoute and delPeer may rely on it instead of reading it again for every peer
+	refresh() error
+	// peerRoute programs whatever the route to the pod subnet of a peer needs and returns the route,
+	// ok is false if the peer hasn't published what the backend needs yet
+	peerRoute(node *corev1.Node, podCIDR *net.IPNet, nodeIP net.IP) (_ netlink.Route, ok bool, err error)
+	// delPeer removes what peerRoute programmed besides the route itself
+	delPeer(route netlink.Route) error
+	// prunePeers removes what peerRoute programmed for the peers without a route in routes, keyed by pod CIDR,
+	// e.g. the ones of nodes deleted while the daemon wasn't running
+	prunePeers(routes map[string]netlink.Route) error
+	// close releases what setup acquired once the daemon stops
+	close() error
+	// watchedAnnotations are the node annotations the backend reads from peers
+	watchedAnnotations() []string
+}
+
+func newBackend(conf *daemonConf, r *Reconciler) (backend, error) {
+	var overlay backend
+	switch conf.backend {
+	case backendHostGW:
+		return &hostGWBackend{r: r}, nil
+	case backendVXLAN:
+		overlay = &vxlanBackend{r: r, vni: conf.vxlanVNI, port: conf.vxlanPort}
+	case backendIPIP:
+		overlay = &ipipBackend{r: r}
+	case backendWireguard:
+		overlay = &wireguardBackend{r: r, port: conf.wireguardPort, keyFile: conf.wireguardKeyFile}
+	default:
+		return nil, fmt.Errorf("unknown backend %q", conf.backend)
+	}
+	if conf.directRouting {
+		return &directRoutingBackend{r: r, overlay: overlay, hostGW: &hostGWBackend{r: r}}, nil
+	}
+	return overlay, nil
+}
+
+// setTunnelUp gives the tunnel device the network address of the pod subnet, which the node uses as source
+// when it reaches the other nodes' pods through the tunnel, and brings it up.
+func setTunnelUp(link netlink.Link, podCIDR *net.IPNet) error {
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: podCIDR.IP, Mask: net.CIDRMask(32, 32)}}
+	if err := netlink.AddrAdd(link, addr); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to add %s to %s: %v", addr.IPNet, link.Attrs().Name, err)
+	}
+	return netlink.LinkSetUp(link)
+}
+
+// publishAnnotations sets annotations on the current node, so that the backend on the other nodes can read them.
+func (r *Reconciler) publishAnnotations(node *corev1.Node, annotations map[string]string) error {
+	patch := client.MergeFrom(node.DeepCopy())
+	changed := false
+	for key, value := range annotations {
+		if node.Annotations[key] == value {
+			continue
+		}
+		if node.Annotations == nil {
+			node.Annotations = make(map[string]string)
+		}
+		node.Annotations[key] = value
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if err := r.client.Patch(context.TODO(), node, patch); err != nil {
+		return fmt.Errorf("failed to publish node annotations: %v", err)
+	}
+	log.Info("publish node annotations", "annotations", annotations)
+	return nil
+}
+
+// hostGWBackend routes to the node IP of the peer through the host link.
+type hostGWBackend struct {
+	r *Reconciler
+}
+
+func (b *hostGWBackend) overhead() int {
+	// nothing is added to the packets
+	return 0
+}
+
+func (b *hostGWBackend) setup(*corev1.Node, int) error {
+	return nil
+}
+
+func (b *hostGWBackend) routeLinks() []netlink.Link {
+	return []netlink.Link{b.r.hostLink}
+}
+
+func (b *hostGWBackend) refresh() error {
+	return nil
+}
+
+func (b *hostGWBackend) peerRoute(_ *corev1.Node, podCIDR *net.IPNet, nodeIP net.IP) (netlink.Route, bool, error) {
+	route := netlink.Route{
+		Dst:       podCIDR,
+		Gw:        nodeIP,
+		LinkIndex: b.r.hostLink.Attrs().Index,
+	}
+	if b.r.routeTable != 0 {
+		// the gateway may not be resolvable within the table, e.g. the host link isn't in the VRF
+		route.Table = b.r.routeTable
+		route.Flags = int(netlink.FLAG_ONLINK)
+	}
+	return route, true, nil
+}
+
+func (b *hostGWBackend) delPeer(netlink.Route) error {
+	return nil
+}
+
+func (b *hostGWBackend) prunePeers(map[string]netlink.Route) error {
+	return nil
+}
+
+func (b *hostGWBackend) close() error {
+	return nil
+}
+
+func (b *hostGWBackend) watchedAnnotations() []string {
+	return nil
+}
@@ -0,0 +1,186 @@
+// BandwidthReconciler
+// The bandwidth capability only carries the pod's bandwidth annotations at creation.
+// When they are changed later, the BandwidthReconciler watches the pods on the current node,
+// finds the pod's host veth in the plugin's store by pod IP and reapplies the tc shaping in place.
+// The applied limits are recorded in the store, so that CHECK compares the shaping against them.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/bandwidth"
+	config2 "github.com/mayooot/simple-cni-plugin/pkg/config"
+	"github.com/mayooot/simple-cni-plugin/pkg/store"
+)
+
+const (
+	ingressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+	egressBandwidthAnnotation  = "kubernetes.io/egress-bandwidth"
+
+	// the plugin may not have recorded the host veth yet when the pod IP shows up
+	hostVethRetryInterval = 5 * time.Second
+)
+
+var podBandwidth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "simple_cni_plugin_pod_bandwidth_bits_per_second",
+	Help: "Bandwidth limit currently applied to a pod, 0 means unlimited.",
+}, []string{"namespace", "pod", "direction"})
+
+func init() {
+	metrics.Registry.MustRegister(podBandwidth)
+}
+
+type BandwidthReconciler struct {
+	client client.Client
+	config *daemonConf
+}
+
+func NewBandwidthReconciler(conf *daemonConf, mgr manager.Manager) (*BandwidthReconciler, error) {
+	r := &BandwidthReconciler{
+		client: mgr.GetClient(),
+		config: conf,
+	}
+
+	err := builder.
+		ControllerManagedBy(mgr).
+		For(&corev1.Pod{}).
+		WithEventFilter(predicate.Funcs{
+			// the pod IP is needed to find the host veth, and only changed limits need to be reapplied
+			UpdateFunc: func(event event.UpdateEvent) bool {
+				oldPod, ok := event.ObjectOld.(*corev1.Pod)
+				if !ok {
+					return true
+				}
+				newPod, ok := event.ObjectNew.(*corev1.Pod)
+				if !ok {
+					return true
+				}
+				return oldPod.Status.PodIP != newPod.Status.PodIP ||
+					oldPod.Annotations[ingressBandwidthAnnotation] != newPod.Annotations[ingressBandwidthAnnotation] ||
+					oldPod.Annotations[egressBandwidthAnnotation] != newPod.Annotations[egressBandwidthAnnotation]
+			},
+		}).Complete(r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *BandwidthReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	result := reconcile.Result{}
+	pod := &corev1.Pod{}
+	if err := r.client.Get(ctx, req.NamespacedName, pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			podBandwidth.DeletePartialMatch(prometheus.Labels{"namespace": req.Namespace, "pod": req.Name})
+			return result, nil
+		}
+		return result, err
+	}
+	if pod.Spec.HostNetwork || pod.Spec.NodeName != r.config.nodeName || pod.Status.PodIP == "" {
+		return result, nil
+	}
+
+	bw, err := podBandwidthFromAnnotations(pod.Annotations)
+	if err != nil {
+		log.Error(err, "invalid bandwidth annotations", "pod", req.NamespacedName.String())
+		return result, nil
+	}
+	podIP := net.ParseIP(pod.Status.PodIP)
+	hostVeth, err := r.hostVeth(podIP)
+	if err != nil {
+		return result, err
+	}
+	if hostVeth == "" {
+		return reconcile.Result{RequeueAfter: hostVethRetryInterval}, nil
+	}
+
+	if err = bandwidth.Apply(hostVeth, bw); err != nil {
+		return result, err
+	}
+	if err = r.recordBandwidth(podIP, bw); err != nil {
+		return result, err
+	}
+	log.Info("apply bandwidth", "pod", req.NamespacedName.String(), "host veth", hostVeth,
+		"ingress", bw.IngressRate, "egress", bw.EgressRate)
+	podBandwidth.WithLabelValues(pod.Namespace, pod.Name, "ingress").Set(float64(bw.IngressRate))
+	podBandwidth.WithLabelValues(pod.Namespace, pod.Name, "egress").Set(float64(bw.EgressRate))
+	return result, nil
+}
+
+// hostVeth looks up the host veth recorded by the plugin for ip, it returns "" if there is none yet.
+func (r *BandwidthReconciler) hostVeth(ip net.IP) (string, error) {
+	s, err := store.NewStore(r.config.cniDataDir, r.config.networkName)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+
+	s.Lock()
+	defer s.Unlock()
+	if err = s.LoadData(); err != nil {
+		return "", err
+	}
+	hostVeth, _ := s.GetHostIFByIP(ip)
+	return hostVeth, nil
+}
+
+// recordBandwidth records the limits applied to the pod with ip in the plugin's store.
+func (r *BandwidthReconciler) recordBandwidth(ip net.IP, bw *config2.Bandwidth) error {
+	s, err := store.NewStore(r.config.cniDataDir, r.config.networkName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	s.Lock()
+	defer s.Unlock()
+	if err = s.LoadData(); err != nil {
+		return err
+	}
+	return s.SetBandwidthByIP(ip, bw)
+}
+
+// podBandwidthFromAnnotations converts the bandwidth annotations the same way kubelet does for the bandwidth capability.
+func podBandwidthFromAnnotations(annotations map[string]string) (*config2.Bandwidth, error) {
+	bw := &config2.Bandwidth{}
+	if v, ok := annotations[ingressBandwidthAnnotation]; ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", ingressBandwidthAnnotation, err)
+		}
+		if q.Sign() <= 0 {
+			return nil, fmt.Errorf("%s: %s is not positive", ingressBandwidthAnnotation, v)
+		}
+		bw.IngressRate = uint64(q.Value())
+		bw.IngressBurst = math.MaxInt32
+	}
+	if v, ok := annotations[egressBandwidthAnnotation]; ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", egressBandwidthAnnotation, err)
+		}
+		if q.Sign() <= 0 {
+			return nil, fmt.Errorf("%s: %s is not positive", egressBandwidthAnnotation, v)
+		}
+		bw.EgressRate = uint64(q.Value())
+		bw.EgressBurst = math.MaxInt32
+	}
+	return bw, nil
+}
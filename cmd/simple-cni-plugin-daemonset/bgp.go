@@ -0,0 +1,121 @@
+// BGP speaker
+// The node announces its pod CIDR to the BGP peers, typically the top-of-rack routers, with the node IP as next hop,
+// so that systems outside the cluster can reach pods without SNAT.
+// With --bgp-learn-routes the routes to the other nodes' pod CIDRs are the ones learned from the peers.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/bgp"
+)
+
+// parseBGPPeers parses comma separated peers in the form ip:as.
+func parseBGPPeers(peers string) ([]bgp.Peer, error) {
+	var list []bgp.Peer
+	for _, peer := range strings.Split(peers, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		host, as, err := net.SplitHostPort(peer)
+		if err != nil {
+			return nil, fmt.Errorf("bgp peer %q is invalid: %v", peer, err)
+		}
+		ip := net.ParseIP(host).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("bgp peer %q is invalid: %s isn't an IPv4 address", peer, host)
+		}
+		asn, err := strconv.ParseUint(as, 10, 32)
+		if err != nil || asn == 0 {
+			return nil, fmt.Errorf("bgp peer %q is invalid: AS %q is invalid", peer, as)
+		}
+		list = append(list, bgp.Peer{Address: ip, AS: uint32(asn)})
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("bgp-peers is empty")
+	}
+	return list, nil
+}
+
+// addBGPSpeaker adds a runnable to mgr that runs the BGP speaker, and syncs the learned routes with bgp-learn-routes,
+// whenever they change or resync receives an event.
+func addBGPSpeaker(conf *daemonConf, mgr manager.Manager, r *Reconciler, resync <-chan event.GenericEvent) error {
+	peers, err := parseBGPPeers(conf.bgpPeers)
+	if err != nil {
+		return err
+	}
+	routerID := r.hostIP
+	if conf.bgpRouterID != "" {
+		routerID = net.ParseIP(conf.bgpRouterID)
+	}
+	speaker, err := bgp.NewSpeaker(bgp.Config{
+		AS:       uint32(conf.bgpAS),
+		RouterID: routerID,
+		Log:      log.WithName("bgp"),
+	}, peers)
+	if err != nil {
+		return err
+	}
+	_, podCIDR, err := net.ParseCIDR(r.subnetConfig.Subnet)
+	if err != nil {
+		return err
+	}
+	if err = speaker.Announce(bgp.Route{Prefix: podCIDR, NextHop: r.hostIP}); err != nil {
+		return err
+	}
+
+	return mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if !conf.bgpLearnRoutes {
+			return speaker.Run(ctx)
+		}
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-speaker.Updates():
+				case <-resync:
+				}
+				learned, err := speaker.Learned()
+				if err != nil {
+					log.Error(err, "failed to list learned routes")
+					continue
+				}
+				if err = r.syncLearnedRoutes(ctx, learned, podCIDR); err != nil {
+					log.Error(err, "failed to sync learned routes")
+				}
+			}
+		}()
+		return speaker.Run(ctx)
+	}))
+}
+
+// syncLearnedRoutes routes to the learned pod CIDRs within the cluster CIDR, except the node's own, the same way
+// Reconcile routes to the nodes. A learned route that can't be routed is skipped, so that it doesn't hold back the others.
+func (r *Reconciler) syncLearnedRoutes(ctx context.Context, learned []bgp.Route, podCIDR *net.IPNet) error {
+	return r.sync(ctx, func() (map[string]netlink.Route, error) {
+		routes := make(map[string]netlink.Route)
+		for _, learnedRoute := range learned {
+			if !r.clusterCIDR.Contains(learnedRoute.Prefix.IP) || learnedRoute.Prefix.IP.Equal(podCIDR.IP) {
+				continue
+			}
+			route, _, err := r.backend.peerRoute(nil, learnedRoute.Prefix, learnedRoute.NextHop)
+			if err != nil {
+				log.Error(err, "skip learned route", "prefix", learnedRoute.Prefix.String(), "nextHop", learnedRoute.NextHop.String())
+				continue
+			}
+			routes[learnedRoute.Prefix.String()] = route
+		}
+		return routes, nil
+	})
+}
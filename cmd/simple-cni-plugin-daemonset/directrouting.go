@@ -0,0 +1,94 @@
+// Direct routing
+// The overlay is only needed for the peers the host can't reach at L2. A peer whose node IP is on one of the
+// subnets of the host link gets a plain host-gw route, every other peer goes through the overlay backend.
+// The pod mtu still accounts for the overlay, since pods can't tell which node a destination is on.
+
+package main
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type directRoutingBackend struct {
+	r       *Reconciler
+	overlay backend
+	hostGW  *hostGWBackend
+}
+
+func (b *directRoutingBackend) overhead() int {
+	return b.overlay.overhead()
+}
+
+func (b *directRoutingBackend) setup(node *corev1.Node, mtu int) error {
+	return b.overlay.setup(node, mtu)
+}
+
+func (b *directRoutingBackend) routeLinks() []netlink.Link {
+	return append(b.hostGW.routeLinks(), b.overlay.routeLinks()...)
+}
+
+func (b *directRoutingBackend) refresh() error {
+	return b.overlay.refresh()
+}
+
+func (b *directRoutingBackend) peerRoute(node *corev1.Node, podCIDR *net.IPNet, nodeIP net.IP) (netlink.Route, bool, error) {
+	direct, err := onLink(b.r.hostLink, nodeIP)
+	if err != nil {
+		return netlink.Route{}, false, err
+	}
+	if !direct {
+		return b.overlay.peerRoute(node, podCIDR, nodeIP)
+	}
+	// the peer was reached through the overlay before
+	if current, ok := b.r.routes[podCIDR.String()]; ok && b.isOverlayRoute(current) {
+		if err = b.overlay.delPeer(current); err != nil {
+			return netlink.Route{}, false, err
+		}
+	}
+	return b.hostGW.peerRoute(node, podCIDR, nodeIP)
+}
+
+func (b *directRoutingBackend) delPeer(route netlink.Route) error {
+	if b.isOverlayRoute(route) {
+		return b.overlay.delPeer(route)
+	}
+	return b.hostGW.delPeer(route)
+}
+
+func (b *directRoutingBackend) prunePeers(routes map[string]netlink.Route) error {
+	return b.overlay.prunePeers(routes)
+}
+
+func (b *directRoutingBackend) close() error {
+	return b.overlay.close()
+}
+
+func (b *directRoutingBackend) watchedAnnotations() []string {
+	return b.overlay.watchedAnnotations()
+}
+
+func (b *directRoutingBackend) isOverlayRoute(route netlink.Route) bool {
+	for _, link := range b.overlay.routeLinks() {
+		if route.LinkIndex == link.Attrs().Index {
+			return true
+		}
+	}
+	return false
+}
+
+// onLink reports whether ip is on the same subnet as one of the addresses of link.
+func onLink(link netlink.Link, ip net.IP) (bool, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IPNet.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,214 @@
+// Route drift repair
+// The owned routes may change behind the daemon's back, e.g. someone deletes one by hand or a link flap flushes them.
+// Route, link and address updates that may affect them trigger a resync, and so does a periodic timer as a safety net.
+// A resync compares the owned routes in the kernel with the ones the daemon installed, and the routes that are missing
+// or changed are installed again.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// bursts of updates, e.g. a link flap flushing every route, are handled by a single resync
+const resyncDebounce = time.Second
+
+var routeRepairs = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "simple_cni_plugin_route_repairs_total",
+	Help: "Routes to other nodes' pod subnets that were installed again after they went missing or were changed.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(routeRepairs)
+}
+
+// watchDrift sends an event to resync whenever a netlink update may affect the owned routes, and every
+// resyncInterval if it isn't 0, until ctx is done.
+func (r *Reconciler) watchDrift(ctx context.Context, resync chan<- event.GenericEvent) error {
+	routeUpdates := make(chan netlink.RouteUpdate)
+	linkUpdates := make(chan netlink.LinkUpdate)
+	addrUpdates := make(chan netlink.AddrUpdate)
+	done := ctx.Done()
+	onError := func(err error) {
+		log.Error(err, "netlink subscription error")
+	}
+	if err := netlink.RouteSubscribeWithOptions(routeUpdates, done, netlink.RouteSubscribeOptions{ErrorCallback: onError}); err != nil {
+		return fmt.Errorf("failed to subscribe to route updates: %v", err)
+	}
+	if err := netlink.LinkSubscribeWithOptions(linkUpdates, done, netlink.LinkSubscribeOptions{ErrorCallback: onError}); err != nil {
+		return fmt.Errorf("failed to subscribe to link updates: %v", err)
+	}
+	if err := netlink.AddrSubscribeWithOptions(addrUpdates, done, netlink.AddrSubscribeOptions{ErrorCallback: onError}); err != nil {
+		return fmt.Errorf("failed to subscribe to address updates: %v", err)
+	}
+
+	_, podCIDR, err := net.ParseCIDR(r.subnetConfig.Subnet)
+	if err != nil {
+		return err
+	}
+	// the links are tracked by name, a recreated link gets a new index
+	routeLinkNames, routeLinks := sets.New[string](), sets.New[int]()
+	for _, link := range r.backend.routeLinks() {
+		routeLinkNames.Insert(link.Attrs().Name)
+		routeLinks.Insert(link.Attrs().Index)
+	}
+	// routes within the node's pod subnet are the plugin's
+	relevantRoute := func(route netlink.Route) bool {
+		if route.Protocol == routeProtocol {
+			return true
+		}
+		return route.Dst != nil && r.clusterCIDR.Contains(route.Dst.IP) && !podCIDR.Contains(route.Dst.IP)
+	}
+
+	var periodic <-chan time.Time
+	if r.config.resyncInterval > 0 {
+		ticker := time.NewTicker(r.config.resyncInterval)
+		defer ticker.Stop()
+		periodic = ticker.C
+	}
+	debounce := time.NewTimer(resyncDebounce)
+	debounce.Stop()
+	pending := false
+	trigger := func() {
+		if !pending {
+			pending = true
+			debounce.Reset(resyncDebounce)
+		}
+	}
+	send := func() {
+		select {
+		case resync <- event.GenericEvent{Object: &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: r.config.nodeName}}}:
+		default:
+			// a resync is already queued
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case update, ok := <-routeUpdates:
+			if !ok {
+				return fmt.Errorf("route subscription closed")
+			}
+			if relevantRoute(update.Route) {
+				trigger()
+			}
+		case update, ok := <-linkUpdates:
+			if !ok {
+				return fmt.Errorf("link subscription closed")
+			}
+			if routeLinkNames.Has(update.Attrs().Name) {
+				if update.Header.Type == syscall.RTM_DELLINK {
+					routeLinks.Delete(update.Attrs().Index)
+				} else {
+					routeLinks.Insert(update.Attrs().Index)
+				}
+				trigger()
+			}
+			// in VRF mode, a recreated bridge has to be enslaved again
+			if r.config.vrf != "" && update.Attrs().Name == r.subnetConfig.Bridge {
+				trigger()
+			}
+		case update, ok := <-addrUpdates:
+			if !ok {
+				return fmt.Errorf("address subscription closed")
+			}
+			if routeLinks.Has(update.LinkIndex) {
+				trigger()
+			}
+		case <-debounce.C:
+			pending = false
+			send()
+		case <-periodic:
+			send()
+		}
+	}
+}
+
+// checkRouteLinks sets up the backend again if one of its links disappeared, e.g. it was deleted by hand, so that the
+// routes are installed through the new link. A recreated host link is looked up again.
+func (r *Reconciler) checkRouteLinks(ctx context.Context) error {
+	missing := false
+	for _, link := range r.backend.routeLinks() {
+		current, err := netlink.LinkByIndex(link.Attrs().Index)
+		if err == nil && current.Attrs().Name == link.Attrs().Name {
+			continue
+		}
+		log.Info("route link disappeared", "link", link.Attrs().Name)
+		missing = true
+		if link.Attrs().Name != r.hostLink.Attrs().Name {
+			continue
+		}
+		if r.hostLink, err = netlink.LinkByName(r.hostLink.Attrs().Name); err != nil {
+			return fmt.Errorf("failed to get host link %s: %v", link.Attrs().Name, err)
+		}
+	}
+	if !missing {
+		return nil
+	}
+	node := &corev1.Node{}
+	if err := r.client.Get(ctx, types.NamespacedName{Name: r.config.nodeName}, node); err != nil {
+		return err
+	}
+	if err := r.backend.setup(node, r.mtu); err != nil {
+		return fmt.Errorf("failed to set up backend %s: %v", r.config.backend, err)
+	}
+	return nil
+}
+
+// forgetDriftedRoutes compares the owned routes in the kernel with r.routes. Missing routes are forgotten along with
+// their peers and changed routes are replaced by the kernel's version, so that syncRoutes installs them again.
+// It returns their pod CIDRs.
+func (r *Reconciler) forgetDriftedRoutes() (sets.Set[string], error) {
+	table := r.routeTable
+	if table == 0 {
+		table = syscall.RT_TABLE_MAIN
+	}
+	routeList, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Protocol: routeProtocol,
+		Table:    table,
+	}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]netlink.Route)
+	for _, route := range routeList {
+		if route.Dst != nil {
+			current[route.Dst.String()] = route
+		}
+	}
+
+	drifted := sets.New[string]()
+	for podCIDR, route := range r.routes {
+		currentRoute, ok := current[podCIDR]
+		if ok && isRouteEqual(route, currentRoute) {
+			continue
+		}
+		drifted.Insert(podCIDR)
+		if ok {
+			log.Info("route changed", "route", route.String(), "current", currentRoute.String())
+			r.routes[podCIDR] = currentRoute
+		} else {
+			log.Info("route missing", "route", route.String())
+			if err = r.backend.delPeer(route); err != nil {
+				return nil, err
+			}
+			delete(r.routes, podCIDR)
+		}
+	}
+	return drifted, nil
+}
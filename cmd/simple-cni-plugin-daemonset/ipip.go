@@ -0,0 +1,114 @@
+// IPIP backend
+// Pod traffic to the other nodes is encapsulated in IP protocol 4 by a single tunnel device without a remote,
+// the outer destination is taken from the gateway of each route, which is the peer's node IP reached onlink.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	ipipName = "scni-tunl"
+	// outer IPv4 header
+	ipipOverhead = 20
+)
+
+type ipipBackend struct {
+	r *Reconciler
+
+	tunnel netlink.Link
+}
+
+func (b *ipipBackend) overhead() int {
+	return ipipOverhead
+}
+
+// setup creates the tunnel device if it doesn't exist.
+func (b *ipipBackend) setup(node *corev1.Node, mtu int) error {
+	hostIP, err := getNodeInternalIP(node)
+	if err != nil {
+		return err
+	}
+	_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		return err
+	}
+	if b.tunnel, err = b.ensureTunnel(hostIP, mtu); err != nil {
+		return err
+	}
+	return setTunnelUp(b.tunnel, podCIDR)
+}
+
+func (b *ipipBackend) ensureTunnel(hostIP net.IP, mtu int) (netlink.Link, error) {
+	tunnel := &netlink.Iptun{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: ipipName,
+			MTU:  mtu,
+		},
+		Link:     uint32(b.r.hostLink.Attrs().Index),
+		Local:    hostIP,
+		PMtuDisc: 1,
+	}
+	link, err := netlink.LinkByName(ipipName)
+	if err == nil {
+		existing, ok := link.(*netlink.Iptun)
+		if ok && existing.Local.Equal(tunnel.Local) && existing.Link == tunnel.Link &&
+			(existing.Remote == nil || existing.Remote.IsUnspecified()) {
+			if existing.MTU != mtu {
+				if err = netlink.LinkSetMTU(existing, mtu); err != nil {
+					return nil, err
+				}
+			}
+			return existing, nil
+		}
+		log.Info("recreate ipip tunnel", "tunnel", ipipName)
+		if err = netlink.LinkDel(link); err != nil {
+			return nil, err
+		}
+	}
+	if err = netlink.LinkAdd(tunnel); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", ipipName, err)
+	}
+	return netlink.LinkByName(ipipName)
+}
+
+func (b *ipipBackend) routeLinks() []netlink.Link {
+	return []netlink.Link{b.tunnel}
+}
+
+func (b *ipipBackend) refresh() error {
+	return nil
+}
+
+func (b *ipipBackend) peerRoute(_ *corev1.Node, podCIDR *net.IPNet, nodeIP net.IP) (netlink.Route, bool, error) {
+	route := netlink.Route{
+		Dst:       podCIDR,
+		Gw:        nodeIP,
+		LinkIndex: b.tunnel.Attrs().Index,
+		// the node IP isn't on the tunnel's subnet, it's only the outer destination
+		Flags: int(netlink.FLAG_ONLINK),
+		Table: b.r.routeTable,
+	}
+	return route, true, nil
+}
+
+func (b *ipipBackend) delPeer(netlink.Route) error {
+	return nil
+}
+
+func (b *ipipBackend) prunePeers(map[string]netlink.Route) error {
+	return nil
+}
+
+func (b *ipipBackend) close() error {
+	return nil
+}
+
+func (b *ipipBackend) watchedAnnotations() []string {
+	return nil
+}
@@ -1,8 +1,8 @@
 // simple-cni-plugin-daemonset will be deployed on every node in K8s Cluster.
 // The main function is to listen to all node resources in the cluster, and when a node's pod CIDR changes,
 // trigger a reconcile, and change the route rules of the current host.
-// When daemonset starts for the first time, it will save the pod CIDR and bridge name (default is cni0) as a subnet range
-// in /run/simple-cni-plugin-subnet.json on the host, and create the bridge using the first available IP of the pod CIDR.
+// When daemonset starts for the first time, it will save the pod CIDR, bridge name (default is cni0) and the pod mtu
+// (derived from the host link unless --mtu is set) as a subnet range in /run/simple-cni-plugin-subnet.json on the host, and create the bridge using the first available IP of the pod CIDR.
 // If iptables feature is enabled, it will use iptables to create the corresponding rules.
 // For example, it will allow packets to be forwarded through the bridge and the default network interface,
 // and packets int pod CIDR range leaving the current host do NAT.
@@ -10,34 +10,53 @@
 // Reconciler
 // When reconcile is triggered, it processes all nodes except itself, performing the following steps.
 // Get the pod CIDR of a node, get the IP of the node used for intra-cluster communication,
-// and generate a routing rule: dst is pod CIDR, gateway is node IP.
+// and let the backend generate a routing rule: with host-gw dst is pod CIDR, gateway is node IP,
+// with vxlan gateway is the node's VTEP and the neighbor and FDB entries of the VTEP are programmed too,
+// with ipip gateway is the node IP through the tunnel device,
+// with wireguard there is no gateway and the node's public key and endpoint are configured as a wireguard peer.
+// With --direct-routing the nodes whose IP is on one of the host link's subnets get the host-gw route instead.
+// With --bgp-learn-routes the node list isn't watched, the routes are learned from the BGP peers.
 // Add the generated rule if it doesn't exist on the current node, or compare it to update it if it already exists.
 // Finally, delete the route rules of the removed nodes.
+// Every route the daemon installs is tagged with its own route protocol, and only tagged routes are rediscovered
+// on restart, changed or deleted. With --route-table they are kept in a dedicated table looked up by an ip rule.
+// Netlink updates that may affect the owned routes and --resync-interval trigger a reconcile too, which installs
+// the routes that went missing or were changed again.
 package main
 
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"net"
 	"os"
+	"syscall"
+	"time"
 
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/mayooot/simple-cni-plugin/pkg/bridge"
 	config2 "github.com/mayooot/simple-cni-plugin/pkg/config"
@@ -45,6 +64,10 @@ import (
 
 const (
 	appName = "simple-cni-plugin-daemonSet"
+	// routeProtocol tags every route the daemon installs, only routes with this protocol are ever changed or deleted
+	routeProtocol netlink.RouteProtocol = 83
+	// routeRulePriority is the priority of the rule that looks up the cluster cidr in the route table, before the main table
+	routeRulePriority = 1000
 )
 
 var (
@@ -55,12 +78,62 @@ type daemonConf struct {
 	clusterCIDR    string
 	nodeName       string
 	enableIptables bool
+	mtu            int
+	// mode is recorded in the subnet file, the plugin's network config doesn't need to repeat it
+	mode string
+	// vrf is the VRF the bridge is enslaved to, there is none if empty
+	vrf      string
+	vrfTable int
+	// routeTable holds the routes to the other nodes' pod subnets instead of the main table if not 0
+	routeTable int
+	// backend is how pod traffic reaches the other nodes
+	backend          string
+	vxlanVNI         int
+	vxlanPort        int
+	wireguardPort    int
+	wireguardKeyFile string
+	// directRouting uses host-gw routes for the peers on the host link's subnets, only with an overlay backend
+	directRouting bool
+	// bgpAS enables the BGP speaker, which announces the pod CIDR of the node to bgpPeers
+	bgpAS       uint
+	bgpRouterID string
+	bgpPeers    string
+	// bgpLearnRoutes takes the routes to the other nodes' pod CIDRs from the BGP peers instead of the node list
+	bgpLearnRoutes bool
+
+	// resyncInterval is how often the routes are synced even without any update
+	resyncInterval time.Duration
+
+	watchBandwidth     bool
+	cniDataDir         string
+	networkName        string
+	metricsBindAddress string
 }
 
 func (c *daemonConf) addFlags() {
 	flag.StringVar(&c.clusterCIDR, "cluster-cidr", "", "cluster pod cidr")
 	flag.StringVar(&c.nodeName, "node", "", "current node name")
 	flag.BoolVar(&c.enableIptables, "enable-iptables", false, "add iptables forward and nat rules")
+	flag.IntVar(&c.mtu, "mtu", 0, "mtu of the bridge and pod interfaces, derived from the host link if not set")
+	flag.StringVar(&c.mode, "mode", config2.ModeBridge, "datapath mode of the plugin, bridge, routed, macvlan or ipvlan, the bridge is only created in bridge mode")
+	flag.StringVar(&c.vrf, "vrf", "", "enslave the bridge to this VRF to keep pod traffic out of the main routing table, only in bridge mode")
+	flag.IntVar(&c.vrfTable, "vrf-table", 1000, "routing table of the VRF")
+	flag.IntVar(&c.routeTable, "route-table", 0, "routing table for the routes to the other nodes' pod subnets, looked up for the cluster cidr by an ip rule, the main table if 0")
+	flag.StringVar(&c.backend, "backend", backendHostGW, "how pod traffic reaches the other nodes, host-gw if all nodes share an L2 segment, vxlan, ipip or wireguard to encrypt it")
+	flag.IntVar(&c.vxlanVNI, "vxlan-vni", 1, "VNI of the vxlan backend")
+	flag.IntVar(&c.vxlanPort, "vxlan-port", 4789, "UDP port of the vxlan backend")
+	flag.IntVar(&c.wireguardPort, "wireguard-port", 51820, "UDP port of the wireguard backend")
+	flag.StringVar(&c.wireguardKeyFile, "wireguard-key-file", "/run/simple-cni-plugin/wireguard.key", "private key of the wireguard backend, generated if it doesn't exist")
+	flag.BoolVar(&c.directRouting, "direct-routing", false, "route natively to the nodes on the host link's subnets and use the overlay backend only for the others")
+	flag.UintVar(&c.bgpAS, "bgp-as", 0, "AS of the BGP speaker, which announces the pod cidr of the node to the BGP peers, disabled if 0")
+	flag.StringVar(&c.bgpRouterID, "bgp-router-id", "", "router id of the BGP speaker, the node ip if not set")
+	flag.StringVar(&c.bgpPeers, "bgp-peers", "", "comma separated BGP peers as ip:as")
+	flag.BoolVar(&c.bgpLearnRoutes, "bgp-learn-routes", false, "route to the other nodes' pod cidrs learned from the BGP peers instead of the node list, only with backend host-gw")
+	flag.DurationVar(&c.resyncInterval, "resync-interval", 5*time.Minute, "how often the routes are synced even without any update, disabled if 0")
+	flag.BoolVar(&c.watchBandwidth, "watch-bandwidth", false, "reapply pod bandwidth limits when their annotations change")
+	flag.StringVar(&c.cniDataDir, "cni-data-dir", "/var/lib/cni/networks", "dataDir of the plugin's network config")
+	flag.StringVar(&c.networkName, "network-name", "simple-cni-plugin", "name of the plugin's network config")
+	flag.StringVar(&c.metricsBindAddress, "metrics-bind-address", ":9090", "address the metrics endpoint binds to")
 }
 
 func (c *daemonConf) parseConfig() error {
@@ -73,6 +146,71 @@ func (c *daemonConf) parseConfig() error {
 	if len(c.nodeName) == 0 {
 		return fmt.Errorf("node name is empty")
 	}
+	if c.mtu < 0 {
+		return fmt.Errorf("mtu %d is invalid", c.mtu)
+	}
+	switch c.mode {
+	case config2.ModeBridge, config2.ModeRouted:
+	case config2.ModeMacvlan, config2.ModeIPvlan:
+		// pods have no host veth to shape traffic on
+		if c.watchBandwidth {
+			return fmt.Errorf("watch-bandwidth isn't supported in mode %s", c.mode)
+		}
+	default:
+		return fmt.Errorf("mode %q is invalid", c.mode)
+	}
+	switch c.backend {
+	case backendHostGW, backendVXLAN, backendIPIP, backendWireguard:
+	default:
+		return fmt.Errorf("backend %q is invalid", c.backend)
+	}
+	// direct routing would bypass the encryption of wireguard
+	if c.directRouting && c.backend != backendVXLAN && c.backend != backendIPIP {
+		return fmt.Errorf("direct-routing requires backend %s or %s", backendVXLAN, backendIPIP)
+	}
+	if c.wireguardPort <= 0 || c.wireguardPort > 65535 {
+		return fmt.Errorf("wireguard-port %d is invalid", c.wireguardPort)
+	}
+	if c.vxlanVNI <= 0 || c.vxlanVNI >= 1<<24 {
+		return fmt.Errorf("vxlan-vni %d is invalid", c.vxlanVNI)
+	}
+	if c.vxlanPort <= 0 || c.vxlanPort > 65535 {
+		return fmt.Errorf("vxlan-port %d is invalid", c.vxlanPort)
+	}
+	if c.bgpAS > math.MaxUint32 {
+		return fmt.Errorf("bgp-as %d is invalid", c.bgpAS)
+	}
+	if c.bgpAS != 0 {
+		if _, err := parseBGPPeers(c.bgpPeers); err != nil {
+			return err
+		}
+		if c.bgpRouterID != "" && net.ParseIP(c.bgpRouterID).To4() == nil {
+			return fmt.Errorf("bgp-router-id %q is invalid", c.bgpRouterID)
+		}
+	}
+	if c.bgpLearnRoutes && (c.bgpAS == 0 || c.backend != backendHostGW) {
+		return fmt.Errorf("bgp-learn-routes requires bgp-as and backend %s", backendHostGW)
+	}
+	if c.resyncInterval < 0 {
+		return fmt.Errorf("resync-interval %s is invalid", c.resyncInterval)
+	}
+	if c.routeTable != 0 {
+		if c.vrf != "" {
+			return fmt.Errorf("route-table can't be used with vrf, the routes are in the vrf table")
+		}
+		if c.routeTable < 0 || (c.routeTable >= 253 && c.routeTable <= 255) {
+			return fmt.Errorf("route-table %d is invalid", c.routeTable)
+		}
+	}
+	if c.vrf != "" {
+		if c.mode != config2.ModeBridge {
+			return fmt.Errorf("vrf requires mode %s", config2.ModeBridge)
+		}
+		// 253 to 255 are the default, main and local tables
+		if c.vrfTable <= 0 || (c.vrfTable >= 253 && c.vrfTable <= 255) {
+			return fmt.Errorf("vrf-table %d is invalid", c.vrfTable)
+		}
+	}
 	return nil
 }
 
@@ -96,7 +234,15 @@ func main() {
 }
 
 func RunController(conf *daemonConf) error {
-	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{})
+	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{
+		Metrics: metricsserver.Options{BindAddress: conf.metricsBindAddress},
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				// only pods on the current node are of interest
+				&corev1.Pod{}: {Field: fields.OneTermEqualSelector("spec.nodeName", conf.nodeName)},
+			},
+		},
+	})
 	if err != nil {
 		log.Error(err, "failed to create manager")
 		return err
@@ -106,30 +252,70 @@ func RunController(conf *daemonConf) error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := reconciler.backend.close(); err != nil {
+			log.Error(err, "failed to close backend")
+		}
+	}()
 	log.Info("create manager success")
 
-	err = builder.
-		ControllerManagedBy(mgr).
-		For(&corev1.Node{}).
-		WithEventFilter(predicate.Funcs{
-			// if assert failed or node's podCIDR has changed, it should be processed
-			UpdateFunc: func(event event.UpdateEvent) bool {
-				oldNode, ok := event.ObjectOld.(*corev1.Node)
-				if !ok {
-					return true
-				}
-				newNode, ok := event.ObjectNew.(*corev1.Node)
-				if !ok {
-					return true
-				}
-				return oldNode.Spec.PodCIDR != newNode.Spec.PodCIDR
-			},
-		}).Complete(reconciler)
+	// route drift and the periodic resync trigger a resync through this channel
+	resync := make(chan event.GenericEvent, 1)
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		return reconciler.watchDrift(ctx, resync)
+	}))
 	if err != nil {
-		log.Error(err, "failed to create controller")
 		return err
 	}
 
+	if conf.bgpAS != 0 {
+		if err = addBGPSpeaker(conf, mgr, reconciler, resync); err != nil {
+			log.Error(err, "failed to create bgp speaker")
+			return err
+		}
+	}
+
+	// otherwise the routes are learned from the BGP peers
+	if !conf.bgpLearnRoutes {
+		err = builder.
+			ControllerManagedBy(mgr).
+			For(&corev1.Node{}).
+			WatchesRawSource(&source.Channel{Source: resync}, &handler.EnqueueRequestForObject{}).
+			WithEventFilter(predicate.Funcs{
+				// if assert failed or node's podCIDR or an annotation the backend reads has changed, it should be processed
+				UpdateFunc: func(event event.UpdateEvent) bool {
+					oldNode, ok := event.ObjectOld.(*corev1.Node)
+					if !ok {
+						return true
+					}
+					newNode, ok := event.ObjectNew.(*corev1.Node)
+					if !ok {
+						return true
+					}
+					if oldNode.Spec.PodCIDR != newNode.Spec.PodCIDR {
+						return true
+					}
+					for _, annotation := range reconciler.backend.watchedAnnotations() {
+						if oldNode.Annotations[annotation] != newNode.Annotations[annotation] {
+							return true
+						}
+					}
+					return false
+				},
+			}).Complete(reconciler)
+		if err != nil {
+			log.Error(err, "failed to create controller")
+			return err
+		}
+	}
+
+	if conf.watchBandwidth {
+		if _, err = NewBandwidthReconciler(conf, mgr); err != nil {
+			log.Error(err, "failed to create bandwidth controller")
+			return err
+		}
+	}
+
 	return mgr.Start(signals.SetupSignalHandler())
 }
 
@@ -137,8 +323,14 @@ type Reconciler struct {
 	client      client.Client
 	clusterCIDR *net.IPNet
 
-	hostLink     netlink.Link
-	routes       map[string]netlink.Route
+	hostIP   net.IP
+	hostLink netlink.Link
+	backend  backend
+	// mtu of the backend's links, which are set up again if they disappear
+	mtu    int
+	routes map[string]netlink.Route
+	// routeTable holds the routes to the other nodes' pod subnets, the main table if 0
+	routeTable   int
 	config       *daemonConf
 	subnetConfig *config2.SubnetConf
 }
@@ -168,14 +360,6 @@ func NewReconciler(conf *daemonConf, mgr manager.Manager) (*Reconciler, error) {
 
 	log.Info("get node info", "host ip", hostIP.String(), "node clusterCIDR", podCIDR.String())
 
-	subnetConf := &config2.SubnetConf{
-		Subnet: podCIDR.String(),
-		Bridge: config2.DefaultBridgeName,
-	}
-	if err := config2.StoreSubnetConfig(subnetConf); err != nil {
-		return nil, err
-	}
-
 	var hostLink netlink.Link
 	linkList, err := netlink.LinkList()
 	if err != nil {
@@ -201,19 +385,92 @@ Loop:
 	}
 	log.Info(fmt.Sprintf("get host link success, type: %s, name: %s, index: %d", hostLink.Type(), hostLink.Attrs().Name, hostLink.Attrs().Index))
 
-	if _, err = bridge.CreateBridge(subnetConf.Bridge, 1500, &net.IPNet{IP: ip.NextIP(podCIDR.IP), Mask: podCIDR.Mask}); err != nil {
+	r := &Reconciler{
+		client:      mgr.GetClient(),
+		clusterCIDR: clusterCIDR,
+		hostIP:      hostIP,
+		hostLink:    hostLink,
+		config:      conf,
+	}
+	if r.backend, err = newBackend(conf, r); err != nil {
+		return nil, err
+	}
+
+	mtu := conf.mtu
+	if mtu == 0 {
+		mtu = hostLink.Attrs().MTU - r.backend.overhead()
+	}
+	log.Info("get pod mtu", "mtu", mtu, "backend", conf.backend)
+	r.mtu = mtu
+
+	subnetConf := &config2.SubnetConf{
+		Subnet:       podCIDR.String(),
+		Bridge:       config2.DefaultBridgeName,
+		MTU:          mtu,
+		DatapathMode: conf.mode,
+	}
+	if err := config2.StoreSubnetConfig(subnetConf); err != nil {
+		return nil, err
+	}
+
+	// in the other modes the plugin routes every pod through its host veth or the shim
+	podBridge := ""
+	if conf.mode == config2.ModeBridge {
+		podBridge = subnetConf.Bridge
+		gateway := &net.IPNet{IP: ip.NextIP(podCIDR.IP), Mask: podCIDR.Mask}
+		_, corrections, err := bridge.CreateBridge(subnetConf.Bridge, subnetConf.MTU, gateway, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, correction := range corrections {
+			log.Info("correct bridge", "bridge", subnetConf.Bridge, "correction", correction)
+		}
+		if conf.vrf != "" {
+			if err = setupVRF(conf, subnetConf.Bridge, gateway, hostLink); err != nil {
+				return nil, err
+			}
+			log.Info("set up vrf success", "vrf", conf.vrf, "table", conf.vrfTable)
+			// forwarded pod traffic may be seen as entering through the VRF device rather than the bridge
+			podBridge = ""
+		}
+	}
+
+	listTable := syscall.RT_TABLE_MAIN
+	if conf.vrf != "" {
+		r.routeTable, listTable = conf.vrfTable, conf.vrfTable
+	}
+	if conf.routeTable != 0 {
+		r.routeTable, listTable = conf.routeTable, conf.routeTable
+	}
+	if err = ensureRouteRule(clusterCIDR, conf.routeTable); err != nil {
 		return nil, err
 	}
+	if err = r.backend.setup(node, mtu); err != nil {
+		return nil, fmt.Errorf("failed to set up backend %s: %v", conf.backend, err)
+	}
 
+	routeLinks := r.backend.routeLinks()
 	if conf.enableIptables {
-		if err = addIptables(subnetConf.Bridge, hostLink.Attrs().Name, subnetConf.Subnet); err != nil {
+		// traffic from the other nodes' pods enters through the links of the backend
+		hostDeviceNames := make([]string, 0, len(routeLinks))
+		for _, link := range routeLinks {
+			hostDeviceNames = append(hostDeviceNames, link.Attrs().Name)
+		}
+		if err = addIptables(podBridge, hostDeviceNames, subnetConf.Subnet); err != nil {
 			return nil, err
 		}
 		log.Info("set iptables success")
 	}
 
+	// only the routes installed by the daemon are rediscovered
 	routes := make(map[string]netlink.Route)
-	routeList, err := netlink.RouteList(hostLink, netlink.FAMILY_V4)
+	routeList, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Protocol: routeProtocol,
+		Table:    listTable,
+	}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
 	for _, route := range routeList {
 		if route.Dst != nil && !route.Dst.IP.Equal(podCIDR.IP) && clusterCIDR.Contains(route.Dst.IP) {
 			routes[route.Dst.String()] = route
@@ -221,14 +478,9 @@ Loop:
 	}
 	log.Info("get local routes", "routes", routes)
 
-	return &Reconciler{
-		client:       mgr.GetClient(),
-		clusterCIDR:  clusterCIDR,
-		hostLink:     hostLink,
-		routes:       routes,
-		config:       conf,
-		subnetConfig: subnetConf,
-	}, nil
+	r.routes = routes
+	r.subnetConfig = subnetConf
+	return r, nil
 }
 
 func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
@@ -239,8 +491,42 @@ func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 		return result, err
 	}
 
+	return result, r.sync(ctx, func() (map[string]netlink.Route, error) {
+		return r.nodeRoutes(nodes.Items)
+	})
+}
+
+// sync repairs the links of the node and converges the owned routes to the ones returned by routes, which is called
+// after the backend has been refreshed.
+func (r *Reconciler) sync(ctx context.Context, routes func() (map[string]netlink.Route, error)) error {
+	if err := r.checkRouteLinks(ctx); err != nil {
+		return err
+	}
+	if err := r.backend.refresh(); err != nil {
+		return err
+	}
+	// the peers of the missing routes are deleted before they're programmed again
+	drifted, err := r.forgetDriftedRoutes()
+	if err != nil {
+		return err
+	}
+	desired, err := routes()
+	if err != nil {
+		return err
+	}
+	if err = r.backend.prunePeers(desired); err != nil {
+		return err
+	}
+	if err = r.checkVRF(); err != nil {
+		return err
+	}
+	return r.syncRoutes(desired, drifted)
+}
+
+// nodeRoutes returns the routes to the pod CIDRs of the other nodes, keyed by pod CIDR.
+func (r *Reconciler) nodeRoutes(nodes []corev1.Node) (map[string]netlink.Route, error) {
 	routes := make(map[string]netlink.Route)
-	for _, node := range nodes.Items {
+	for _, node := range nodes {
 		if node.Name == r.config.nodeName {
 			continue
 		}
@@ -249,43 +535,62 @@ func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 		}
 		_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
 		if err != nil {
-			return result, err
+			return nil, err
 		}
 		nodeIP, err := getNodeInternalIP(&node)
 		if err != nil {
 			log.Error(err, "failed to get host")
 			continue
 		}
-		route := netlink.Route{
-			Dst:        podCIDR,
-			Gw:         nodeIP,
-			ILinkIndex: r.hostLink.Attrs().Index,
+		route, ok, err := r.backend.peerRoute(&node, podCIDR, nodeIP)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Info("node isn't ready for the backend yet", "node", node.Name, "backend", r.config.backend)
+			continue
 		}
 		routes[podCIDR.String()] = route
+	}
+	return routes, nil
+}
 
-		if currentRoute, ok := r.routes[podCIDR.String()]; ok {
+// syncRoutes adds or replaces the routes that differ from the current ones and deletes the current routes not in routes,
+// which are keyed by pod CIDR. The routes in drifted, as returned by forgetDriftedRoutes, are counted as repairs.
+func (r *Reconciler) syncRoutes(routes map[string]netlink.Route, drifted sets.Set[string]) error {
+	var err error
+	for podCIDR, route := range routes {
+		if currentRoute, ok := r.routes[podCIDR]; ok {
 			if isRouteEqual(route, currentRoute) {
 				continue
 			}
-			if err := r.ReplaceRoute(currentRoute); err != nil {
-				return result, err
+			if err := r.ReplaceRoute(route); err != nil {
+				return err
 			}
 		} else {
-			if err := r.addRoute(route); err != nil {
-				return result, err
+			err = r.addRoute(route)
+			if errors.Is(err, syscall.EEXIST) {
+				// a route the daemon doesn't own, which is left alone
+				log.Info("skip route that isn't owned by the daemon", "route", route.String())
+				continue
 			}
+			if err != nil {
+				return err
+			}
+		}
+		if drifted.Has(podCIDR) {
+			routeRepairs.Inc()
 		}
 	}
 
 	for podCIDR, route := range r.routes {
 		if _, ok := routes[podCIDR]; !ok {
 			if err := r.delRoute(route); err != nil {
-				return result, err
+				return err
 			}
 		}
 	}
-
-	return result, nil
+	return nil
 }
 
 func (r *Reconciler) addRoute(route netlink.Route) (err error) {
@@ -295,6 +600,7 @@ func (r *Reconciler) addRoute(route netlink.Route) (err error) {
 		}
 	}()
 
+	route.Protocol = routeProtocol
 	log.Info(fmt.Sprintf("add route: %s", route.String()))
 	err = netlink.RouteAdd(&route)
 	if err != nil {
@@ -311,7 +617,10 @@ func (r *Reconciler) delRoute(route netlink.Route) (err error) {
 	}()
 
 	log.Info(fmt.Sprintf("del route: %s", route.String()))
-	err = netlink.RouteDel(&route)
+	if err = netlink.RouteDel(&route); err != nil {
+		return
+	}
+	err = r.backend.delPeer(route)
 	return
 }
 
@@ -322,23 +631,68 @@ func (r *Reconciler) ReplaceRoute(route netlink.Route) (err error) {
 		}
 	}()
 
+	route.Protocol = routeProtocol
 	log.Info(fmt.Sprintf("replace route: %s", route.String()))
 	err = netlink.RouteReplace(&route)
 	return
 }
 
-func addIptables(bridgeName, hostDeviceName, podCIDR string) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+// ensureRouteRule adds the rule that looks up destinations in clusterCIDR in table if it doesn't exist, and deletes
+// the rules left behind by previous tables. No rule is kept if table is 0.
+func ensureRouteRule(clusterCIDR *net.IPNet, table int) error {
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
 	if err != nil {
 		return err
 	}
+	exists := false
+	for _, rule := range rules {
+		if rule.Priority != routeRulePriority || rule.Dst == nil || rule.Dst.String() != clusterCIDR.String() {
+			continue
+		}
+		if rule.Table == table {
+			exists = true
+			continue
+		}
+		log.Info("delete stale route rule", "dst", clusterCIDR.String(), "table", rule.Table)
+		if err = netlink.RuleDel(&rule); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete rule to %s lookup %d: %v", clusterCIDR, rule.Table, err)
+		}
+	}
+	if exists || table == 0 {
+		return nil
+	}
+	rule := netlink.NewRule()
+	rule.Family = netlink.FAMILY_V4
+	rule.Dst = clusterCIDR
+	rule.Table = table
+	rule.Priority = routeRulePriority
+	if err = netlink.RuleAdd(rule); err != nil {
+		return fmt.Errorf("failed to add rule to %s lookup %d: %v", clusterCIDR, table, err)
+	}
+	log.Info("add route rule", "dst", clusterCIDR.String(), "table", table)
+	return nil
+}
 
-	if err = ipt.AppendUnique("filter", "FORWARD", "-i", bridgeName, "-j", "ACCEPT"); err != nil {
+// addIptables accepts forwarded pod traffic, which enters through bridgeName, or through the host veths if bridgeName is empty,
+// and the traffic from the other nodes, which enters through hostDeviceNames.
+func addIptables(bridgeName string, hostDeviceNames []string, podCIDR string) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
 		return err
 	}
-	if err = ipt.AppendUnique("filter", "FORWARD", "-i", hostDeviceName, "-j", "ACCEPT"); err != nil {
+
+	fromPods := []string{"-i", bridgeName}
+	if bridgeName == "" {
+		fromPods = []string{"-s", podCIDR}
+	}
+	if err = ipt.AppendUnique("filter", "FORWARD", append(fromPods, "-j", "ACCEPT")...); err != nil {
 		return err
 	}
+	for _, hostDeviceName := range hostDeviceNames {
+		if err = ipt.AppendUnique("filter", "FORWARD", "-i", hostDeviceName, "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
 	if err = ipt.AppendUnique("nat", "POSTROUTING", "-s", podCIDR, "-j", "MASQUERADE"); err != nil {
 		return err
 	}
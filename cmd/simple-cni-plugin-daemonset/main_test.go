@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	config2 "github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+func TestSyncRoutesSkipUntagged(t *testing.T) {
+	testNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testNS.Close()
+
+	err = testNS.Do(func(ns.NetNS) error {
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}, PeerName: "eth1"}))
+		hostLink, err := netlink.LinkByName("eth0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(hostLink))
+		require.NoError(t, netlink.AddrAdd(hostLink, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(192, 168, 0, 10), Mask: net.CIDRMask(24, 32)}}))
+
+		_, clusterCIDR, _ := net.ParseCIDR("10.244.0.0/16")
+		r := &Reconciler{
+			clusterCIDR:  clusterCIDR,
+			hostLink:     hostLink,
+			routes:       make(map[string]netlink.Route),
+			config:       &daemonConf{},
+			subnetConfig: &config2.SubnetConf{Subnet: "10.244.1.0/24"},
+		}
+		r.backend = &hostGWBackend{r: r}
+
+		// an untagged route through the host link to a pod subnet, which someone else installed
+		_, foreign, _ := net.ParseCIDR("10.244.2.0/24")
+		_, owned, _ := net.ParseCIDR("10.244.3.0/24")
+		require.NoError(t, netlink.RouteAdd(&netlink.Route{Dst: foreign, Gw: net.IPv4(192, 168, 0, 2), LinkIndex: hostLink.Attrs().Index}))
+
+		routes := make(map[string]netlink.Route)
+		for i, dst := range []*net.IPNet{foreign, owned} {
+			routes[dst.String()] = netlink.Route{Dst: dst, Gw: net.IPv4(192, 168, 0, byte(3+i)), LinkIndex: hostLink.Attrs().Index}
+		}
+		require.NoError(t, r.syncRoutes(routes, nil))
+		require.NotContains(t, r.routes, foreign.String())
+		require.Contains(t, r.routes, owned.String())
+
+		requireRoute := func(dst *net.IPNet, protocol netlink.RouteProtocol, gw net.IP) {
+			list, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst, Table: syscall.RT_TABLE_MAIN},
+				netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+			require.NoError(t, err)
+			require.Len(t, list, 1)
+			require.Equal(t, protocol, list[0].Protocol)
+			require.True(t, gw.Equal(list[0].Gw))
+		}
+		requireRoute(foreign, netlink.RouteProtocol(syscall.RTPROT_BOOT), net.IPv4(192, 168, 0, 2))
+		requireRoute(owned, routeProtocol, net.IPv4(192, 168, 0, 4))
+
+		// the untagged route is still left alone on the next sync
+		require.NoError(t, r.syncRoutes(routes, nil))
+		requireRoute(foreign, netlink.RouteProtocol(syscall.RTPROT_BOOT), net.IPv4(192, 168, 0, 2))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestEnsureRouteRule(t *testing.T) {
+	testNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testNS.Close()
+
+	err = testNS.Do(func(ns.NetNS) error {
+		_, clusterCIDR, _ := net.ParseCIDR("10.244.0.0/16")
+		tables := func() []int {
+			rules, err := netlink.RuleList(netlink.FAMILY_V4)
+			require.NoError(t, err)
+			var tables []int
+			for _, rule := range rules {
+				if rule.Priority == routeRulePriority && rule.Dst != nil && rule.Dst.String() == clusterCIDR.String() {
+					tables = append(tables, rule.Table)
+				}
+			}
+			return tables
+		}
+
+		require.NoError(t, ensureRouteRule(clusterCIDR, 100))
+		require.NoError(t, ensureRouteRule(clusterCIDR, 100))
+		require.Equal(t, []int{100}, tables())
+
+		// the rule of the previous table is replaced
+		require.NoError(t, ensureRouteRule(clusterCIDR, 200))
+		require.Equal(t, []int{200}, tables())
+
+		require.NoError(t, ensureRouteRule(clusterCIDR, 0))
+		require.Empty(t, tables())
+		return nil
+	})
+	require.NoError(t, err)
+}
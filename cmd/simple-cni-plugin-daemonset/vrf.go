@@ -0,0 +1,140 @@
+// VRF mode
+// The bridge is enslaved to a VRF device, so pod traffic is forwarded by the VRF's routing table only
+// and the host's own routes never apply to it, nor do the pod routes apply to host traffic.
+// The routes to the other nodes' pod subnets are installed in the VRF table, and only a few routes are leaked:
+// the local pod subnet into the main table for node-to-pod traffic, and the host's default route into the VRF
+// table so that pods still reach the rest of the cluster and the outside world.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+)
+
+// l3mdevAccept lets sockets in the default VRF accept the replies of pods, which arrive through the VRF
+var l3mdevAccept = []string{
+	"net/ipv4/tcp_l3mdev_accept",
+	"net/ipv4/udp_l3mdev_accept",
+	"net/ipv4/raw_l3mdev_accept",
+}
+
+// setupVRF creates the VRF named conf.vrf if it doesn't exist, enslaves the bridge to it and installs the leak routes.
+func setupVRF(conf *daemonConf, bridgeName string, gateway *net.IPNet, hostLink netlink.Link) error {
+	vrf, err := ensureVRF(conf.vrf, uint32(conf.vrfTable))
+	if err != nil {
+		return err
+	}
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return err
+	}
+	if br.Attrs().MasterIndex != vrf.Attrs().Index {
+		// the connected route of the bridge moves into the VRF table
+		if err = netlink.LinkSetMaster(br, vrf); err != nil {
+			return fmt.Errorf("failed to enslave %s to %s: %v", bridgeName, conf.vrf, err)
+		}
+		log.Info("enslave bridge to vrf", "bridge", bridgeName, "vrf", conf.vrf)
+	}
+
+	// node-to-pod traffic is sourced from the gateway, which pods reach within the VRF
+	podRoute := &netlink.Route{
+		LinkIndex: br.Attrs().Index,
+		Dst:       &net.IPNet{IP: gateway.IP.Mask(gateway.Mask), Mask: gateway.Mask},
+		Src:       gateway.IP,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     syscall.RT_TABLE_MAIN,
+		Protocol:  routeProtocol,
+	}
+	if err = netlink.RouteReplace(podRoute); err != nil {
+		return fmt.Errorf("failed to leak %s into the main table: %v", podRoute.Dst, err)
+	}
+
+	defaultRoutes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		LinkIndex: hostLink.Attrs().Index,
+		Table:     syscall.RT_TABLE_MAIN,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, route := range defaultRoutes {
+		if route.Dst != nil || route.Gw == nil {
+			continue
+		}
+		leak := &netlink.Route{
+			LinkIndex: hostLink.Attrs().Index,
+			Gw:        route.Gw,
+			Table:     conf.vrfTable,
+			Flags:     int(netlink.FLAG_ONLINK),
+			Protocol:  routeProtocol,
+		}
+		if err = netlink.RouteReplace(leak); err != nil {
+			return fmt.Errorf("failed to leak the default route into %s: %v", conf.vrf, err)
+		}
+		break
+	}
+
+	for _, key := range l3mdevAccept {
+		if _, err = sysctl.Sysctl(key, "1"); err != nil {
+			return fmt.Errorf("failed to set %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// checkVRF sets up the VRF again on every reconcile, so that a bridge recreated outside the VRF is enslaved again and
+// deleted leak routes or reset l3mdev sysctls are repaired. Every step of setupVRF is idempotent.
+// A missing bridge is left to the plugin, which creates it on the next ADD.
+func (r *Reconciler) checkVRF() error {
+	if r.config.vrf == "" {
+		return nil
+	}
+	if _, err := netlink.LinkByName(r.subnetConfig.Bridge); err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	_, podCIDR, err := net.ParseCIDR(r.subnetConfig.Subnet)
+	if err != nil {
+		return err
+	}
+	gateway := &net.IPNet{IP: ip.NextIP(podCIDR.IP), Mask: podCIDR.Mask}
+	return setupVRF(r.config, r.subnetConfig.Bridge, gateway, r.hostLink)
+}
+
+// ensureVRF returns the VRF named name, creating it if it doesn't exist, and makes sure it is up.
+func ensureVRF(name string, table uint32) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, err
+		}
+		if err = netlink.LinkAdd(&netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: name}, Table: table}); err != nil {
+			return nil, fmt.Errorf("failed to create vrf %s: %v", name, err)
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return nil, err
+		}
+		log.Info("create vrf", "vrf", name, "table", table)
+	}
+	vrf, ok := link.(*netlink.Vrf)
+	if !ok {
+		return nil, fmt.Errorf("%s already exists and is a %s", name, link.Type())
+	}
+	if vrf.Table != table {
+		return nil, fmt.Errorf("vrf %s uses table %d, expected %d", name, vrf.Table, table)
+	}
+	if err = netlink.LinkSetUp(vrf); err != nil {
+		return nil, err
+	}
+	return vrf, nil
+}
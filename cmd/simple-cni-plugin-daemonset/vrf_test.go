@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	config2 "github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+// newVRFNS returns a new netns, it skips the test if the kernel has no VRF support.
+func newVRFNS(t *testing.T) ns.NetNS {
+	testNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	err = testNS.Do(func(ns.NetNS) error {
+		return netlink.LinkAdd(&netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: "vrf-probe"}, Table: 4242})
+	})
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		testNS.Close()
+		t.Skip("the kernel has no VRF support")
+	}
+	require.NoError(t, err)
+	return testNS
+}
+
+func TestEnsureVRF(t *testing.T) {
+	testNS := newVRFNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		vrf, err := ensureVRF("vrf-pods", 1000)
+		require.NoError(t, err)
+		require.Equal(t, uint32(1000), vrf.(*netlink.Vrf).Table)
+
+		again, err := ensureVRF("vrf-pods", 1000)
+		require.NoError(t, err)
+		require.Equal(t, vrf.Attrs().Index, again.Attrs().Index)
+		link, err := netlink.LinkByName("vrf-pods")
+		require.NoError(t, err)
+		require.NotZero(t, link.Attrs().Flags&net.FlagUp)
+
+		_, err = ensureVRF("vrf-pods", 1001)
+		require.Error(t, err)
+
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}))
+		_, err = ensureVRF("veth0", 1000)
+		require.Error(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCheckVRF(t *testing.T) {
+	testNS := newVRFNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}, PeerName: "eth1"}))
+		hostLink, err := netlink.LinkByName("eth0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(hostLink))
+		require.NoError(t, netlink.AddrAdd(hostLink, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(192, 168, 0, 10), Mask: net.CIDRMask(24, 32)}}))
+		require.NoError(t, netlink.RouteAdd(&netlink.Route{LinkIndex: hostLink.Attrs().Index, Gw: net.IPv4(192, 168, 0, 1)}))
+
+		r := &Reconciler{
+			hostLink:     hostLink,
+			config:       &daemonConf{vrf: "vrf-pods", vrfTable: 1000},
+			subnetConfig: &config2.SubnetConf{Subnet: "10.244.1.0/24", Bridge: "cni0"},
+		}
+		// the plugin creates the bridge on the first ADD
+		require.NoError(t, r.checkVRF())
+
+		createBridge := func() netlink.Link {
+			br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "cni0"}}
+			require.NoError(t, netlink.LinkAdd(br))
+			require.NoError(t, netlink.LinkSetUp(br))
+			require.NoError(t, netlink.AddrAdd(br, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(10, 244, 1, 1), Mask: net.CIDRMask(24, 32)}}))
+			return br
+		}
+		requireEnslaved := func() {
+			br, err := netlink.LinkByName("cni0")
+			require.NoError(t, err)
+			vrf, err := netlink.LinkByName("vrf-pods")
+			require.NoError(t, err)
+			require.Equal(t, vrf.Attrs().Index, br.Attrs().MasterIndex)
+
+			// the default route is leaked into the VRF table
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 1000}, netlink.RT_FILTER_TABLE)
+			require.NoError(t, err)
+			leaked := false
+			for _, route := range routes {
+				if route.Dst == nil && route.Gw.Equal(net.IPv4(192, 168, 0, 1)) {
+					leaked = true
+				}
+			}
+			require.True(t, leaked)
+
+			// the pod subnet is leaked into the main table
+			routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+				LinkIndex: br.Attrs().Index,
+				Table:     syscall.RT_TABLE_MAIN,
+			}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+			require.NoError(t, err)
+			require.Len(t, routes, 1)
+			require.Equal(t, "10.244.1.0/24", routes[0].Dst.String())
+		}
+
+		createBridge()
+		require.NoError(t, r.checkVRF())
+		requireEnslaved()
+
+		// a bridge recreated outside the VRF is enslaved again
+		br, err := netlink.LinkByName("cni0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkDel(br))
+		createBridge()
+		require.NoError(t, r.checkVRF())
+		requireEnslaved()
+
+		// deleted leak routes and a reset sysctl are repaired while the bridge stays enslaved
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 1000}, netlink.RT_FILTER_TABLE)
+		require.NoError(t, err)
+		for _, route := range routes {
+			if route.Dst == nil {
+				require.NoError(t, netlink.RouteDel(&route))
+			}
+		}
+		br, err = netlink.LinkByName("cni0")
+		require.NoError(t, err)
+		routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+			LinkIndex: br.Attrs().Index,
+			Table:     syscall.RT_TABLE_MAIN,
+		}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		require.NoError(t, err)
+		for _, route := range routes {
+			require.NoError(t, netlink.RouteDel(&route))
+		}
+		_, err = sysctl.Sysctl(l3mdevAccept[0], "0")
+		require.NoError(t, err)
+		require.NoError(t, r.checkVRF())
+		requireEnslaved()
+		value, err := sysctl.Sysctl(l3mdevAccept[0])
+		require.NoError(t, err)
+		require.Equal(t, "1", value)
+
+		// nothing to do without a VRF
+		r.config.vrf = ""
+		require.NoError(t, r.checkVRF())
+		return nil
+	})
+	require.NoError(t, err)
+}
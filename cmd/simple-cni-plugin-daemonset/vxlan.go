@@ -0,0 +1,206 @@
+// VXLAN backend
+// Every node has a VTEP whose address is the network address of its pod subnet and whose mac is published
+// in a node annotation. For each peer the backend programs:
+// a neighbor entry from the peer's VTEP address to its VTEP mac,
+// a FDB entry that sends frames for the peer's VTEP mac to the peer's node IP,
+// and an onlink route to the peer's pod subnet via the peer's VTEP address.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	vxlanName = "scni-vxlan"
+	// outer IPv4 + UDP + VXLAN headers and the inner ethernet header
+	vxlanOverhead = 50
+
+	vtepMACAnnotation = "simple-cni-plugin/vtep-mac"
+)
+
+type vxlanBackend struct {
+	r    *Reconciler
+	vni  int
+	port int
+
+	vtep netlink.Link
+}
+
+func (b *vxlanBackend) overhead() int {
+	return vxlanOverhead
+}
+
+// setup creates the VTEP if it doesn't exist and publishes its mac on the node.
+func (b *vxlanBackend) setup(node *corev1.Node, mtu int) error {
+	hostIP, err := getNodeInternalIP(node)
+	if err != nil {
+		return err
+	}
+	_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		return err
+	}
+	if b.vtep, err = b.ensureVTEP(hostIP, mtu); err != nil {
+		return err
+	}
+	if err = setTunnelUp(b.vtep, podCIDR); err != nil {
+		return err
+	}
+
+	return b.r.publishAnnotations(node, map[string]string{
+		vtepMACAnnotation: b.vtep.Attrs().HardwareAddr.String(),
+	})
+}
+
+func (b *vxlanBackend) ensureVTEP(hostIP net.IP, mtu int) (netlink.Link, error) {
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: vxlanName,
+			MTU:  mtu,
+		},
+		VxlanId:      b.vni,
+		VtepDevIndex: b.r.hostLink.Attrs().Index,
+		SrcAddr:      hostIP,
+		Port:         b.port,
+		// the FDB is programmed from the node annotations
+		Learning: false,
+	}
+	link, err := netlink.LinkByName(vxlanName)
+	if err == nil {
+		existing, ok := link.(*netlink.Vxlan)
+		if ok && existing.VxlanId == vxlan.VxlanId && existing.VtepDevIndex == vxlan.VtepDevIndex &&
+			existing.SrcAddr.Equal(vxlan.SrcAddr) && existing.Port == vxlan.Port {
+			if existing.MTU != mtu {
+				if err = netlink.LinkSetMTU(existing, mtu); err != nil {
+					return nil, err
+				}
+			}
+			return existing, nil
+		}
+		// the settings can't be changed in place, the mac of the new VTEP is published again
+		log.Info("recreate vtep", "vtep", vxlanName)
+		if err = netlink.LinkDel(link); err != nil {
+			return nil, err
+		}
+	}
+	if err = netlink.LinkAdd(vxlan); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", vxlanName, err)
+	}
+	return netlink.LinkByName(vxlanName)
+}
+
+func (b *vxlanBackend) routeLinks() []netlink.Link {
+	return []netlink.Link{b.vtep}
+}
+
+func (b *vxlanBackend) refresh() error {
+	return nil
+}
+
+func (b *vxlanBackend) peerRoute(node *corev1.Node, podCIDR *net.IPNet, nodeIP net.IP) (netlink.Route, bool, error) {
+	mac, err := net.ParseMAC(node.Annotations[vtepMACAnnotation])
+	if err != nil {
+		return netlink.Route{}, false, nil
+	}
+	vtepIndex := b.vtep.Attrs().Index
+	err = netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    vtepIndex,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		IP:           podCIDR.IP,
+		HardwareAddr: mac,
+	})
+	if err != nil {
+		return netlink.Route{}, false, fmt.Errorf("failed to add neighbor %s of node %s: %v", podCIDR.IP, node.Name, err)
+	}
+	if err = delStaleFDB(vtepIndex, nodeIP, mac); err != nil {
+		return netlink.Route{}, false, fmt.Errorf("failed to delete stale fdb entries of node %s: %v", node.Name, err)
+	}
+	err = netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    vtepIndex,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT,
+		Flags:        netlink.NTF_SELF,
+		IP:           nodeIP,
+		HardwareAddr: mac,
+	})
+	if err != nil {
+		return netlink.Route{}, false, fmt.Errorf("failed to add fdb entry of node %s: %v", node.Name, err)
+	}
+
+	route := netlink.Route{
+		Dst:       podCIDR,
+		Gw:        podCIDR.IP,
+		LinkIndex: vtepIndex,
+		Flags:     int(netlink.FLAG_ONLINK),
+		Table:     b.r.routeTable,
+	}
+	return route, true, nil
+}
+
+// delStaleFDB removes the FDB entries that send frames to nodeIP for another mac than mac,
+// which are left behind when the peer recreates its VTEP with a new mac.
+func delStaleFDB(vtepIndex int, nodeIP net.IP, mac net.HardwareAddr) error {
+	fdb, err := netlink.NeighList(vtepIndex, syscall.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+	for _, entry := range fdb {
+		if !entry.IP.Equal(nodeIP) || entry.HardwareAddr.String() == mac.String() {
+			continue
+		}
+		log.Info("delete stale fdb entry", "nodeIP", nodeIP.String(), "mac", entry.HardwareAddr.String())
+		if err = netlink.NeighDel(&entry); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return err
+		}
+	}
+	return nil
+}
+
+// delPeer removes the neighbor entry of the peer's VTEP and the FDB entries of its mac.
+func (b *vxlanBackend) delPeer(route netlink.Route) error {
+	vtepIndex := b.vtep.Attrs().Index
+	neighs, err := netlink.NeighList(vtepIndex, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, neigh := range neighs {
+		if !neigh.IP.Equal(route.Gw) {
+			continue
+		}
+		if err = netlink.NeighDel(&neigh); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return err
+		}
+		fdb, err := netlink.NeighList(vtepIndex, syscall.AF_BRIDGE)
+		if err != nil {
+			return err
+		}
+		for _, entry := range fdb {
+			if entry.HardwareAddr.String() == neigh.HardwareAddr.String() {
+				if err = netlink.NeighDel(&entry); err != nil && !errors.Is(err, syscall.ENOENT) {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *vxlanBackend) prunePeers(map[string]netlink.Route) error {
+	return nil
+}
+
+func (b *vxlanBackend) close() error {
+	return nil
+}
+
+func (b *vxlanBackend) watchedAnnotations() []string {
+	return []string{vtepMACAnnotation}
+}
@@ -0,0 +1,302 @@
+// WireGuard backend
+// Pod traffic to the other nodes is encrypted by a single wireguard device. Every node keeps its private key in a
+// file on the host and publishes the public key and its endpoint in node annotations. Each peer is configured with
+// its pod subnet as the only allowed ip, and the route to the pod subnet goes through the device.
+// A node that loses its key file generates a new key pair and publishes it again, the other nodes then replace
+// the peer with the old key in the same reconcile that handles any other change of the node.
+// The device is configured over generic netlink, its peers are read once per reconcile, and the peers that match no
+// node, e.g. of the nodes deleted while the daemon wasn't running, are removed.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	wireguardName = "scni-wg"
+	// outer IPv4 + UDP headers and the wireguard header and authentication tag
+	wireguardOverhead = 60
+
+	wireguardPublicKeyAnnotation = "simple-cni-plugin/wireguard-public-key"
+	wireguardEndpointAnnotation  = "simple-cni-plugin/wireguard-endpoint"
+)
+
+type wireguardBackend struct {
+	r       *Reconciler
+	port    int
+	keyFile string
+
+	client *wgctrl.Client
+	device netlink.Link
+	// peers of the device by public key, read by refresh and kept up to date by peerRoute and delPeer
+	peers map[wgtypes.Key]wgtypes.Peer
+}
+
+func (b *wireguardBackend) overhead() int {
+	return wireguardOverhead
+}
+
+// setup creates the wireguard device if it doesn't exist, sets its private key and publishes the public key and endpoint.
+func (b *wireguardBackend) setup(node *corev1.Node, mtu int) error {
+	hostIP, err := getNodeInternalIP(node)
+	if err != nil {
+		return err
+	}
+	_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		return err
+	}
+	privateKey, err := loadWireguardKey(b.keyFile)
+	if err != nil {
+		return err
+	}
+	if b.device, err = ensureWireguard(mtu); err != nil {
+		return err
+	}
+	if b.client == nil {
+		if b.client, err = wgctrl.New(); err != nil {
+			return err
+		}
+	}
+	err = b.client.ConfigureDevice(wireguardName, wgtypes.Config{PrivateKey: &privateKey, ListenPort: &b.port})
+	if err != nil {
+		return fmt.Errorf("failed to configure %s: %v", wireguardName, err)
+	}
+	if err = setTunnelUp(b.device, podCIDR); err != nil {
+		return err
+	}
+	return b.r.publishAnnotations(node, map[string]string{
+		wireguardPublicKeyAnnotation: privateKey.PublicKey().String(),
+		wireguardEndpointAnnotation:  net.JoinHostPort(hostIP.String(), strconv.Itoa(b.port)),
+	})
+}
+
+func (b *wireguardBackend) routeLinks() []netlink.Link {
+	return []netlink.Link{b.device}
+}
+
+// refresh reads the peers of the device.
+func (b *wireguardBackend) refresh() error {
+	device, err := b.client.Device(wireguardName)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", wireguardName, err)
+	}
+	b.peers = make(map[wgtypes.Key]wgtypes.Peer, len(device.Peers))
+	for _, peer := range device.Peers {
+		b.peers[peer.PublicKey] = peer
+	}
+	return nil
+}
+
+func (b *wireguardBackend) peerRoute(node *corev1.Node, podCIDR *net.IPNet, _ net.IP) (netlink.Route, bool, error) {
+	publicKey, err := wgtypes.ParseKey(node.Annotations[wireguardPublicKeyAnnotation])
+	if err != nil {
+		return netlink.Route{}, false, nil
+	}
+	addrPort, err := netip.ParseAddrPort(node.Annotations[wireguardEndpointAnnotation])
+	if err != nil {
+		return netlink.Route{}, false, nil
+	}
+	endpoint := net.UDPAddrFromAddrPort(addrPort)
+
+	route := netlink.Route{
+		Dst:       podCIDR,
+		LinkIndex: b.device.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     b.r.routeTable,
+	}
+	var peers []wgtypes.PeerConfig
+	for key, peer := range b.peers {
+		if key == publicKey {
+			continue
+		}
+		// the node's key has been rotated
+		if containsIPNet(peer.AllowedIPs, podCIDR) {
+			log.Info("remove wireguard peer with a stale key", "node", node.Name)
+			peers = append(peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		}
+	}
+	peer, ok := b.peers[publicKey]
+	if len(peers) == 0 && ok && peer.Endpoint != nil && peer.Endpoint.String() == endpoint.String() &&
+		len(peer.AllowedIPs) == 1 && peer.AllowedIPs[0].String() == podCIDR.String() {
+		return route, true, nil
+	}
+	peers = append(peers, wgtypes.PeerConfig{
+		PublicKey:         publicKey,
+		Endpoint:          endpoint,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        []net.IPNet{*podCIDR},
+	})
+	if err = b.client.ConfigureDevice(wireguardName, wgtypes.Config{Peers: peers}); err != nil {
+		return netlink.Route{}, false, fmt.Errorf("failed to add wireguard peer of node %s: %v", node.Name, err)
+	}
+	for _, peer := range peers[:len(peers)-1] {
+		delete(b.peers, peer.PublicKey)
+	}
+	b.peers[publicKey] = wgtypes.Peer{PublicKey: publicKey, Endpoint: endpoint, AllowedIPs: []net.IPNet{*podCIDR}}
+	return route, true, nil
+}
+
+// delPeer removes the peers whose allowed ips contain the pod subnet of the route.
+func (b *wireguardBackend) delPeer(route netlink.Route) error {
+	var peers []wgtypes.PeerConfig
+	for key, peer := range b.peers {
+		if containsIPNet(peer.AllowedIPs, route.Dst) {
+			peers = append(peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	if err := b.client.ConfigureDevice(wireguardName, wgtypes.Config{Peers: peers}); err != nil {
+		return fmt.Errorf("failed to remove wireguard peers of %s: %v", route.Dst, err)
+	}
+	for _, peer := range peers {
+		delete(b.peers, peer.PublicKey)
+	}
+	return nil
+}
+
+// prunePeers removes the peers whose allowed ips match none of the routes, which are left on the device by nodes
+// deleted while the daemon wasn't running.
+func (b *wireguardBackend) prunePeers(routes map[string]netlink.Route) error {
+	peers := stalePeers(b.peers, routes)
+	if len(peers) == 0 {
+		return nil
+	}
+	log.Info("remove stale wireguard peers", "count", len(peers))
+	if err := b.client.ConfigureDevice(wireguardName, wgtypes.Config{Peers: peers}); err != nil {
+		return fmt.Errorf("failed to remove stale wireguard peers: %v", err)
+	}
+	for _, peer := range peers {
+		delete(b.peers, peer.PublicKey)
+	}
+	return nil
+}
+
+func (b *wireguardBackend) close() error {
+	if b.client == nil {
+		return nil
+	}
+	err := b.client.Close()
+	b.client = nil
+	return err
+}
+
+func (b *wireguardBackend) watchedAnnotations() []string {
+	return []string{wireguardPublicKeyAnnotation, wireguardEndpointAnnotation}
+}
+
+// loadWireguardKey returns the private key in keyFile, a new private key is written to it if it doesn't exist.
+func loadWireguardKey(keyFile string) (wgtypes.Key, error) {
+	data, err := os.ReadFile(keyFile)
+	switch {
+	case err == nil:
+		key, err := wgtypes.ParseKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return wgtypes.Key{}, fmt.Errorf("failed to decode %s: %v", keyFile, err)
+		}
+		return key, nil
+	case errors.Is(err, os.ErrNotExist):
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		if err = writeFileAtomic(keyFile, []byte(key.String()+"\n")); err != nil {
+			return wgtypes.Key{}, err
+		}
+		log.Info("generate wireguard key", "file", keyFile)
+		return key, nil
+	default:
+		return wgtypes.Key{}, err
+	}
+}
+
+// writeFileAtomic writes data to a temporary file readable only by the owner and renames it to name,
+// so that a crash never leaves a partially written file behind.
+func writeFileAtomic(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func ensureWireguard(mtu int) (netlink.Link, error) {
+	link, err := netlink.LinkByName(wireguardName)
+	if err == nil {
+		if _, ok := link.(*netlink.Wireguard); ok {
+			if link.Attrs().MTU != mtu {
+				if err = netlink.LinkSetMTU(link, mtu); err != nil {
+					return nil, err
+				}
+			}
+			return link, nil
+		}
+		log.Info("recreate wireguard device", "device", wireguardName, "type", link.Type())
+		if err = netlink.LinkDel(link); err != nil {
+			return nil, err
+		}
+	}
+	err = netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: wireguardName, MTU: mtu}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", wireguardName, err)
+	}
+	return netlink.LinkByName(wireguardName)
+}
+
+// stalePeers returns the removal of every peer whose allowed ips match none of the routes.
+func stalePeers(peers map[wgtypes.Key]wgtypes.Peer, routes map[string]netlink.Route) []wgtypes.PeerConfig {
+	var stale []wgtypes.PeerConfig
+	for key, peer := range peers {
+		used := false
+		for _, allowedIP := range peer.AllowedIPs {
+			if _, ok := routes[allowedIP.String()]; ok {
+				used = true
+				break
+			}
+		}
+		if !used {
+			stale = append(stale, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		}
+	}
+	return stale
+}
+
+func containsIPNet(list []net.IPNet, ipNet *net.IPNet) bool {
+	for _, item := range list {
+		if item.String() == ipNet.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestLoadWireguardKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "wireguard", "private.key")
+
+	key, err := loadWireguardKey(keyFile)
+	require.NoError(t, err)
+	info, err := os.Stat(keyFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	// the temporary file is renamed
+	entries, err := os.ReadDir(filepath.Dir(keyFile))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	again, err := loadWireguardKey(keyFile)
+	require.NoError(t, err)
+	require.Equal(t, key, again)
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("invalid\n"), 0600))
+	_, err = loadWireguardKey(keyFile)
+	require.Error(t, err)
+}
+
+func TestStalePeers(t *testing.T) {
+	_, live, _ := net.ParseCIDR("10.244.2.0/24")
+	_, deleted, _ := net.ParseCIDR("10.244.3.0/24")
+	liveKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	deletedKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	peers := map[wgtypes.Key]wgtypes.Peer{
+		liveKey.PublicKey():    {PublicKey: liveKey.PublicKey(), AllowedIPs: []net.IPNet{*live}},
+		deletedKey.PublicKey(): {PublicKey: deletedKey.PublicKey(), AllowedIPs: []net.IPNet{*deleted}},
+	}
+	routes := map[string]netlink.Route{live.String(): {Dst: live}}
+	require.Equal(t, []wgtypes.PeerConfig{{PublicKey: deletedKey.PublicKey(), Remove: true}}, stalePeers(peers, routes))
+
+	routes[deleted.String()] = netlink.Route{Dst: deleted}
+	require.Empty(t, stalePeers(peers, routes))
+}
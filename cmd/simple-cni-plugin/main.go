@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -9,10 +11,14 @@ import (
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/vishvananda/netlink"
 
 	"github.com/mayooot/simple-cni-plugin/pkg/bridge"
 	"github.com/mayooot/simple-cni-plugin/pkg/config"
+	"github.com/mayooot/simple-cni-plugin/pkg/direct"
 	"github.com/mayooot/simple-cni-plugin/pkg/ipam"
+	"github.com/mayooot/simple-cni-plugin/pkg/logging"
+	"github.com/mayooot/simple-cni-plugin/pkg/portmap"
 	"github.com/mayooot/simple-cni-plugin/pkg/store"
 )
 
@@ -21,10 +27,74 @@ const (
 )
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, buildversion.BuildString(pluginName))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:   withLogging("ADD", cmdAdd),
+		Del:   withLogging("DEL", cmdDel),
+		Check: withLogging("CHECK", cmdCheck),
+		GC:    withLogging("GC", cmdGC),
+	}, version.All, buildversion.BuildString(pluginName))
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+// withLogging parses CNI_ARGS and sets up the log file for cmd, every line carries what identifies the attachment,
+// so that the history of a pod can be found across ADD, CHECK and DEL.
+func withLogging(command string, cmd func(*skel.CmdArgs, *config.K8sArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		k8sArgs, argsErr := config.LoadK8sArgs(args.Args)
+		lenient := argsErr != nil && command == "DEL"
+		if lenient {
+			// malformed args must not keep DEL from releasing the ip and removing the devices
+			k8sArgs = config.LoadK8sArgsLenient(args.Args)
+		}
+		pod := ""
+		if k8sArgs != nil {
+			pod = k8sArgs.PodName()
+		}
+		logging.Init(config.LoadLogConf(args.StdinData),
+			"command", command,
+			"containerID", args.ContainerID,
+			"netns", args.Netns,
+			"ifName", args.IfName,
+			"pod", pod,
+		)
+		logging.Log.V(1).Info("start", "args", args.Args)
+		if lenient {
+			logging.Log.Info("ignore malformed CNI_ARGS", "reason", argsErr.Error())
+		} else if argsErr != nil {
+			logging.Log.Error(argsErr, "failed")
+			return argsErr
+		}
+		if err := cmd(args, k8sArgs); err != nil {
+			logging.Log.Error(err, "failed")
+			return err
+		}
+		logging.Log.Info("done")
+		return nil
+	}
+}
+
+// rollback records how to undo each completed step of ADD,
+// so that a failure in a later step doesn't leave a reserved ip or half-created devices behind.
+type rollback struct {
+	undos []func() error
+}
+
+func (r *rollback) add(undo func() error) {
+	r.undos = append(r.undos, undo)
+}
+
+// run undoes the recorded steps in reverse order, it keeps going when a step fails.
+func (r *rollback) run() error {
+	var errs []error
+	for i := len(r.undos) - 1; i >= 0; i-- {
+		if err := r.undos[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	r.undos = nil
+	return errors.Join(errs...)
+}
+
+func cmdAdd(args *skel.CmdArgs, k8sArgs *config.K8sArgs) (err error) {
 	conf, err := config.LoadCNIConfig(args.StdinData)
 	if err != nil {
 		return err
@@ -39,17 +109,77 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return fmt.Errorf("failed to create ipam: %v", err)
 	}
-	gateway := im.Gateway()
-	ip, err := im.AllocateIP(args.ContainerID, args.IfName)
+	rb := &rollback{}
+	defer func() {
+		if err != nil {
+			logging.Log.Info("roll back", "reason", err.Error())
+			if rbErr := rb.run(); rbErr != nil {
+				err = fmt.Errorf("%v, rollback failed: %v", err, rbErr)
+			}
+		}
+	}()
+
+	requested, err := conf.RequestedIP(k8sArgs)
 	if err != nil {
 		return err
 	}
-
-	mtu := 1500
-	br, err := bridge.CreateBridge(conf.Bridge, mtu, im.IPNet(gateway))
+	// a repeated ADD gets the ip the container already owns, which a failure must not release
+	_, checkErr := im.CheckIP(args.ContainerID)
+	owned := checkErr == nil
+	ip, err := im.AllocateIP(args.ContainerID, args.IfName, requested)
 	if err != nil {
 		return err
 	}
+	if !owned {
+		rb.add(func() error {
+			return im.ReleaseIP(args.ContainerID)
+		})
+	}
+
+	mtu := conf.LinkMTU()
+	gateway := im.Gateway()
+	podIP := im.IPNet(ip)
+	var br netlink.Link
+	var dc *direct.Conf
+	vlan := 0
+	switch {
+	case conf.Routed():
+		gateway = bridge.RoutedGateway
+		podIP = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	case conf.Direct():
+		// the sub-interface has no host side to shape traffic on
+		if conf.RuntimeConfig.Bandwidth != nil {
+			return fmt.Errorf("bandwidth isn't supported in mode %s", conf.Mode)
+		}
+		dc = newDirectConf(conf, args)
+		if _, err = direct.EnsureShim(dc, im.IPNet(gateway)); err != nil {
+			return err
+		}
+		if dc.L3() {
+			gateway = nil
+		}
+	default:
+		var corrections []string
+		br, corrections, err = bridge.CreateBridge(conf.Bridge, mtu, im.IPNet(gateway), &conf.BridgeOpts)
+		if err != nil {
+			return err
+		}
+		for _, correction := range corrections {
+			logging.Log.Info("correct bridge", "bridge", conf.Bridge, "correction", correction)
+		}
+		vlan = conf.PodVLAN(k8sArgs)
+		if vlan != 0 {
+			if _, err = bridge.SetupVLAN(br, vlan, gateway, conf.VLANUplink); err != nil {
+				return err
+			}
+			// the pod route of a repeated ADD belongs to the running pod
+			if !owned {
+				rb.add(func() error {
+					return bridge.DelPodRoute(ip)
+				})
+			}
+		}
+	}
 
 	netNS, err := ns.GetNS(args.Netns)
 	if err != nil {
@@ -57,24 +187,129 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netNS.Close()
 
-	if err = bridge.SetupVeth(netNS, br, mtu, args.IfName, im.IPNet(ip), gateway); err != nil {
+	mac, err := conf.RequestedMAC(k8sArgs)
+	if err != nil {
+		return err
+	}
+	if mac == "" && conf.MACFromIP {
+		hw, err := bridge.MACFromIP(ip)
+		if err != nil {
+			return err
+		}
+		mac = hw.String()
+	}
+
+	tun, err := conf.RequestedTuning(k8sArgs)
+	if err != nil {
 		return err
 	}
+	var hostIface, contIface *current.Interface
+	if dc != nil {
+		dc.MAC = mac
+		dc.PodIP = podIP
+		dc.Gateway = gateway
+		dc.Tuning = tun
+		if contIface, err = direct.Setup(netNS, dc); err != nil {
+			return err
+		}
+		rb.add(func() error {
+			return direct.Del(netNS, args.IfName)
+		})
+		logging.Log.Info("setup "+conf.Mode, "master", conf.Master, "ip", podIP.String(), "mtu", mtu)
+	} else {
+		vethConf := &bridge.VethConf{
+			IfName:       args.IfName,
+			HostVethName: bridge.HostVethName(conf.HostVethPrefix, args.ContainerID, args.IfName),
+			MAC:          mac,
+			MTU:          mtu,
+			PodIP:        podIP,
+			Gateway:      gateway,
+			Bandwidth:    conf.RuntimeConfig.Bandwidth,
+			Port:         &conf.PortConf,
+			VLAN:         vlan,
+			Tuning:       tun,
+		}
+		if conf.Routed() {
+			hostIface, contIface, err = bridge.SetupRoutedVeth(netNS, vethConf)
+		} else {
+			hostIface, contIface, err = bridge.SetupVeth(netNS, br, vethConf)
+		}
+		if err != nil {
+			return err
+		}
+		rb.add(func() error {
+			return bridge.DelVeth(netNS, args.IfName, hostIface.Name)
+		})
+		logging.Log.Info("setup veth", "hostVeth", hostIface.Name, "routed", conf.Routed(), "ip", podIP.String(), "mtu", mtu, "vlan", vlan)
+	}
+	// there is no host veth in macvlan and ipvlan mode
+	hostVeth := ""
+	if hostIface != nil {
+		hostVeth = hostIface.Name
+	}
+	if err = recordAttachment(s, args.ContainerID, hostVeth, vlan, k8sArgs); err != nil {
+		return err
+	}
+
+	// pod traffic enters the host through the bridge, the host veth in routed mode or the shim
+	ingress := hostVeth
+	switch {
+	case br != nil:
+		ingress = br.Attrs().Name
+	case conf.Direct():
+		ingress = direct.ShimName
+	}
+	// registered first, so that the chains and rules of a partly failed Forward are removed as well
+	rb.add(func() error {
+		return portmap.Unforward(conf.Name, args.ContainerID)
+	})
+	if err = portmap.Forward(conf.Name, args.ContainerID, ip, ingress, conf.RuntimeConfig.PortMaps); err != nil {
+		return fmt.Errorf("failed to forward host ports: %v", err)
+	}
 
-	result := &current.Result{
-		CNIVersion: current.ImplementedSpecVersion,
-		IPs: []*current.IPConfig{
-			{
-				Address: *im.IPNet(ip),
-				Gateway: gateway,
-			},
-		},
+	// when chained after other plugins, keep what they have reported and append ours
+	result := conf.CurrentPrevResult()
+	if result == nil {
+		result = &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	}
+	if br != nil {
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name: br.Attrs().Name,
+			Mac:  br.Attrs().HardwareAddr.String(),
+			Mtu:  br.Attrs().MTU,
+		})
 	}
+	if hostIface != nil {
+		result.Interfaces = append(result.Interfaces, hostIface)
+	}
+	result.Interfaces = append(result.Interfaces, contIface)
+	result.IPs = append(result.IPs, &current.IPConfig{
+		Interface: current.Int(len(result.Interfaces) - 1),
+		Address:   *podIP,
+		Gateway:   gateway,
+	})
+	result.Routes = append(result.Routes, &types.Route{
+		Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		GW:  gateway,
+	})
 
 	return types.PrintResult(result, conf.CNIVersion)
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+// newDirectConf returns the part of the macvlan or ipvlan config of a container that is known before ADD.
+func newDirectConf(conf *config.CNIConf, args *skel.CmdArgs) *direct.Conf {
+	return &direct.Conf{
+		Mode:        conf.Mode,
+		IPvlanMode:  conf.IPvlanMode,
+		Master:      conf.Master,
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		MTU:         conf.LinkMTU(),
+	}
+}
+
+// cmdDel must succeed when there is nothing left to remove, the netns may already be gone or CNI_NETNS may be empty.
+func cmdDel(args *skel.CmdArgs, k8sArgs *config.K8sArgs) error {
 	conf, err := config.LoadCNIConfig(args.StdinData)
 	if err != nil {
 		return err
@@ -89,20 +324,120 @@ func cmdDel(args *skel.CmdArgs) error {
 	if err != nil {
 		return fmt.Errorf("failed to create ipam: %v", err)
 	}
-	if err = im.ReleaseIP(args.ContainerID); err != nil {
+	hostVeth, err := getHostVeth(s, args.ContainerID)
+	if err != nil {
 		return err
 	}
-
-	netNS, err := ns.GetNS(args.Netns)
+	vlan, err := getVLAN(s, args.ContainerID)
 	if err != nil {
 		return err
 	}
-	defer netNS.Close()
+	if vlan == 0 {
+		// the attachment was recorded before its VLAN was
+		vlan = conf.PodVLAN(k8sArgs)
+	}
 
-	return bridge.DelVeth(netNS, args.IfName)
+	// the runtime may not pass the port mappings to DEL again, e.g. after a restart, so always look for the chains
+	if err = portmap.Unforward(conf.Name, args.ContainerID); err != nil {
+		return fmt.Errorf("failed to remove host ports: %v", err)
+	}
+
+	var netNS ns.NetNS
+	if args.Netns != "" {
+		netNS, err = ns.GetNS(args.Netns)
+		if err != nil {
+			if !isNetNSGone(err) {
+				return err
+			}
+			netNS = nil
+		} else {
+			defer netNS.Close()
+		}
+	}
+	if conf.Direct() {
+		logging.Log.Info("delete "+conf.Mode, "netnsExists", netNS != nil)
+		if err = direct.Del(netNS, args.IfName); err != nil {
+			return err
+		}
+	} else {
+		logging.Log.Info("delete veth", "hostVeth", hostVeth, "netnsExists", netNS != nil)
+		if err = bridge.DelVeth(netNS, args.IfName, hostVeth); err != nil {
+			return err
+		}
+	}
+	// the route to a pod in a VLAN outlives its veth, remove it before the ip can be handed out again
+	if vlan != 0 {
+		if ip, err := im.CheckIP(args.ContainerID); err == nil {
+			if err = bridge.DelPodRoute(ip); err != nil {
+				return err
+			}
+		}
+	}
+
+	// release the ip only after the interfaces are gone, so it can't be handed out while still in use
+	return im.ReleaseIP(args.ContainerID)
+}
+
+// isNetNSGone reports whether the netns path no longer exists or is no longer a netns, e.g. it has been unmounted.
+func isNetNSGone(err error) bool {
+	var notExist ns.NSPathNotExistErr
+	var notNS ns.NSPathNotNSErr
+	return errors.As(err, &notExist) || errors.As(err, &notNS)
+}
+
+// recordAttachment records the host-side veth and VLAN of the container, so that DEL can clean up without the netns
+// or CNI_ARGS, and the pod it belongs to, so that the daemonset can find the attachment of a pod.
+func recordAttachment(s *store.Store, id, hostVeth string, vlan int, k8sArgs *config.K8sArgs) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LoadData(); err != nil {
+		return err
+	}
+	if err := s.SetHostIF(id, hostVeth); err != nil {
+		return err
+	}
+	if err := s.SetVLAN(id, vlan); err != nil {
+		return err
+	}
+	return s.SetPod(id, string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_UID))
 }
 
-func cmdCheck(args *skel.CmdArgs) error {
+func getHostVeth(s *store.Store, id string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LoadData(); err != nil {
+		return "", err
+	}
+	hostVeth, _ := s.GetHostIFByID(id)
+	return hostVeth, nil
+}
+
+func getVLAN(s *store.Store, id string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LoadData(); err != nil {
+		return 0, err
+	}
+	vlan, _ := s.GetVLANByID(id)
+	return vlan, nil
+}
+
+// getBandwidth returns the limits recorded by the daemonset for the container, or nil if there are none.
+func getBandwidth(s *store.Store, id string) (*config.Bandwidth, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LoadData(); err != nil {
+		return nil, err
+	}
+	bw, _ := s.GetBandwidthByID(id)
+	return bw, nil
+}
+
+func cmdCheck(args *skel.CmdArgs, k8sArgs *config.K8sArgs) error {
 	conf, err := config.LoadCNIConfig(args.StdinData)
 	if err != nil {
 		return err
@@ -121,11 +456,143 @@ func cmdCheck(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
+	if k8sArgs.IP != nil && !k8sArgs.IP.Equal(ip) {
+		return fmt.Errorf("%w: container %s has ip %s, CNI_ARGS requested %s", bridge.ContainerVethMismatchError, args.ContainerID, ip, k8sArgs.IP)
+	}
+
+	result := conf.CurrentPrevResult()
+	if result == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	contIface, ips, err := containerResult(result, args.IfName, args.Netns)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, ipc := range ips {
+		if ipc.Address.IP.Equal(ip) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: allocated ip %s of container %s is not in prevResult", bridge.ContainerVethMismatchError, ip, args.ContainerID)
+	}
+
+	if err = portmap.Check(conf.Name, args.ContainerID, ip, conf.RuntimeConfig.PortMaps); err != nil {
+		return err
+	}
+	tun, err := conf.RequestedTuning(k8sArgs)
+	if err != nil {
+		return err
+	}
 	netNS, err := ns.GetNS(args.Netns)
 	if err != nil {
 		return err
 	}
 	defer netNS.Close()
 
-	return bridge.CheckVeth(netNS, args.IfName, ip)
+	if conf.Direct() {
+		dc := newDirectConf(conf, args)
+		dc.Tuning = tun
+		if err = direct.CheckShim(dc, im.Gateway()); err != nil {
+			return err
+		}
+		return direct.Check(netNS, dc, contIface, ips, result.Routes)
+	}
+
+	// the host veth and bridge must be the ones reported by prevResult as well
+	hostVeth, err := getHostVeth(s, args.ContainerID)
+	if err != nil {
+		return err
+	}
+	if hostVeth == "" {
+		// the pod was added before the host veth was recorded, its name is derived as at ADD
+		hostVeth = bridge.HostVethName(conf.HostVethPrefix, args.ContainerID, args.IfName)
+	}
+	if !hasHostInterface(result, hostVeth) {
+		return fmt.Errorf("%w: host veth %q is not in prevResult", bridge.HostVethNotFoundError, hostVeth)
+	}
+	// the daemonset owns the limits once it applied the pod annotations
+	bw, err := getBandwidth(s, args.ContainerID)
+	if err != nil {
+		return err
+	}
+	if bw == nil {
+		bw = conf.RuntimeConfig.Bandwidth
+	}
+	gateway := bridge.RoutedGateway
+	if !conf.Routed() {
+		if !hasHostInterface(result, conf.Bridge) {
+			return fmt.Errorf("%w: bridge %q is not in prevResult", bridge.BridgeNotFoundError, conf.Bridge)
+		}
+		if err = bridge.CheckBridge(conf.Bridge, conf.LinkMTU(), im.IPNet(im.Gateway())); err != nil {
+			return err
+		}
+		gateway = im.Gateway()
+	}
+
+	checkConf := &bridge.CheckConf{
+		Bridge:    conf.Bridge,
+		MTU:       conf.LinkMTU(),
+		IfName:    args.IfName,
+		HostVeth:  hostVeth,
+		Gateway:   gateway,
+		ContIface: contIface,
+		IPs:       ips,
+		Routes:    result.Routes,
+		Bandwidth: bw,
+		Port:      &conf.PortConf,
+		VLAN:      conf.PodVLAN(k8sArgs),
+		Tuning:    tun,
+	}
+	if conf.Routed() {
+		return bridge.CheckRoutedVeth(netNS, checkConf)
+	}
+	return bridge.CheckVeth(netNS, checkConf)
+}
+
+func hasHostInterface(result *current.Result, name string) bool {
+	for _, iface := range result.Interfaces {
+		if iface.Name == name && iface.Sandbox == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdGC removes the host port rules of the containers that the runtime no longer knows about.
+func cmdGC(args *skel.CmdArgs, _ *config.K8sArgs) error {
+	conf, err := config.LoadCNIConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	valid := make(map[string]bool, len(conf.ValidAttachments))
+	for _, attachment := range conf.ValidAttachments {
+		valid[attachment.ContainerID] = true
+	}
+	return portmap.GC(conf.Name, valid)
+}
+
+// containerResult finds the container interface named ifName in result and the ip configs assigned to it.
+func containerResult(result *current.Result, ifName, netns string) (*current.Interface, []*current.IPConfig, error) {
+	idx := -1
+	for i, iface := range result.Interfaces {
+		if iface.Name == ifName && iface.Sandbox == netns {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, nil, fmt.Errorf("failed to find interface %s in netns %s from prevResult", ifName, netns)
+	}
+
+	var ips []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface == idx {
+			ips = append(ips, ipc)
+		}
+	}
+	return result.Interfaces[idx], ips, nil
 }
@@ -0,0 +1,297 @@
+// Package bandwidth shapes the traffic of a pod on its host-side veth with tc.
+//
+// Ingress of the pod is the egress of the host veth, so it is shaped by a tbf qdisc on the host veth.
+// Egress of the pod arrives at the host veth's ingress, where tc can't shape, so it is mirrored
+// to an ifb device and shaped by a tbf qdisc on that device.
+package bandwidth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+const (
+	latencyInMillis = 25
+	ifbPrefix       = "scnibw"
+)
+
+var (
+	IngressMismatchError = errors.New("ingress shaping doesn't match")
+	EgressMismatchError  = errors.New("egress shaping doesn't match")
+)
+
+// Validate checks the rates and bursts of bw.
+func Validate(bw *config.Bandwidth) error {
+	if bw == nil {
+		return nil
+	}
+	if err := validateRateAndBurst(bw.IngressRate, bw.IngressBurst); err != nil {
+		return fmt.Errorf("invalid ingress: %v", err)
+	}
+	if err := validateRateAndBurst(bw.EgressRate, bw.EgressBurst); err != nil {
+		return fmt.Errorf("invalid egress: %v", err)
+	}
+	return nil
+}
+
+func validateRateAndBurst(rate, burst uint64) error {
+	switch {
+	case rate == 0 && burst != 0:
+		return fmt.Errorf("burst is set but rate is not")
+	case rate != 0 && burst == 0:
+		return fmt.Errorf("rate is set but burst is not")
+	case burst/8 >= math.MaxUint32:
+		return fmt.Errorf("burst cannot be more than 4GB")
+	}
+	return nil
+}
+
+// IfbName returns the name of the ifb device that shapes the egress of hostVeth.
+func IfbName(hostVeth string) string {
+	sum := sha256.Sum256([]byte(hostVeth))
+	return fmt.Sprintf("%s%x", ifbPrefix, sum[:4])
+}
+
+// Apply converges the shaping of hostVeth to bw, a nil bw or zero rate removes the shaping of that direction.
+// It can be called again on a shaped veth to change the limits in place.
+func Apply(hostVeth string, bw *config.Bandwidth) error {
+	if err := Validate(bw); err != nil {
+		return err
+	}
+	if bw == nil {
+		bw = &config.Bandwidth{}
+	}
+	link, err := netlink.LinkByName(hostVeth)
+	if err != nil {
+		return err
+	}
+
+	if bw.IngressRate > 0 {
+		if err = netlink.QdiscReplace(tbf(link.Attrs().Index, bw.IngressRate, bw.IngressBurst)); err != nil {
+			return fmt.Errorf("failed to shape ingress on %s: %v", hostVeth, err)
+		}
+	} else if err = delRootTbf(link); err != nil {
+		return err
+	}
+
+	if bw.EgressRate > 0 {
+		if err = setupEgress(link, bw.EgressRate, bw.EgressBurst); err != nil {
+			return fmt.Errorf("failed to shape egress of %s: %v", hostVeth, err)
+		}
+		return nil
+	}
+	return teardownEgress(link)
+}
+
+// Teardown removes the ifb device of hostVeth, the qdiscs on hostVeth go away with the veth itself.
+func Teardown(hostVeth string) error {
+	ifb, err := netlink.LinkByName(IfbName(hostVeth))
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(ifb)
+}
+
+// Check verifies that hostVeth is shaped as bw.
+func Check(hostVeth string, bw *config.Bandwidth) error {
+	if bw == nil {
+		return nil
+	}
+	link, err := netlink.LinkByName(hostVeth)
+	if err != nil {
+		return err
+	}
+	if bw.IngressRate > 0 {
+		if err = checkTbf(link, bw.IngressRate, bw.IngressBurst); err != nil {
+			return fmt.Errorf("%w: %s %v", IngressMismatchError, hostVeth, err)
+		}
+	}
+	if bw.EgressRate > 0 {
+		ifb, err := netlink.LinkByName(IfbName(hostVeth))
+		if err != nil {
+			return fmt.Errorf("%w: %s %v", EgressMismatchError, hostVeth, err)
+		}
+		if err = checkTbf(ifb, bw.EgressRate, bw.EgressBurst); err != nil {
+			return fmt.Errorf("%w: %s %v", EgressMismatchError, hostVeth, err)
+		}
+		if err = checkMirred(link, ifb); err != nil {
+			return fmt.Errorf("%w: %s %v", EgressMismatchError, hostVeth, err)
+		}
+	}
+	return nil
+}
+
+func setupEgress(link netlink.Link, rate, burst uint64) error {
+	ifbName := IfbName(link.Attrs().Name)
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		err = netlink.LinkAdd(&netlink.Ifb{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:  ifbName,
+				Flags: net.FlagUp,
+				MTU:   link.Attrs().MTU,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if ifb, err = netlink.LinkByName(ifbName); err != nil {
+			return err
+		}
+	}
+	if err = netlink.LinkSetUp(ifb); err != nil {
+		return err
+	}
+	if err = netlink.QdiscReplace(tbf(ifb.Attrs().Index, rate, burst)); err != nil {
+		return err
+	}
+
+	// mirror everything the pod sends to the ifb device
+	ingress, err := ensureIngressQdisc(link)
+	if err != nil {
+		return err
+	}
+	return netlink.FilterReplace(&netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+		Actions:    []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	})
+}
+
+func teardownEgress(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Ingress); ok {
+			if err = netlink.QdiscDel(qdisc); err != nil {
+				return err
+			}
+		}
+	}
+	return Teardown(link.Attrs().Name)
+}
+
+func delRootTbf(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		if t, ok := qdisc.(*netlink.Tbf); ok && t.Parent == netlink.HANDLE_ROOT {
+			return netlink.QdiscDel(qdisc)
+		}
+	}
+	return nil
+}
+
+// ensureIngressQdisc adds the ingress qdisc to link if it doesn't have one, the kernel rejects replacing it.
+func ensureIngressQdisc(link netlink.Link) (*netlink.Ingress, error) {
+	ingress := ingressQdisc(link)
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil, err
+	}
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Ingress); ok {
+			return ingress, nil
+		}
+	}
+	return ingress, netlink.QdiscAdd(ingress)
+}
+
+func ingressQdisc(link netlink.Link) *netlink.Ingress {
+	return &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+}
+
+// tbf builds a root tbf qdisc, rate is in bits per second and burst in bits.
+func tbf(linkIndex int, rate, burst uint64) *netlink.Tbf {
+	rateInBytes := rate / 8
+	burstInBytes := burst / 8
+	buffer := bufferInTicks(rateInBytes, uint32(burstInBytes))
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Limit:  limitInBytes(rateInBytes, latencyInMillis*1000, uint32(burstInBytes)),
+		Rate:   rateInBytes,
+		Buffer: buffer,
+	}
+}
+
+func checkTbf(link netlink.Link, rate, burst uint64) error {
+	expected := tbf(link.Attrs().Index, rate, burst)
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		t, ok := qdisc.(*netlink.Tbf)
+		if !ok || t.Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		if t.Rate != expected.Rate || t.Limit != expected.Limit {
+			return fmt.Errorf("tbf on %s has rate %d limit %d, expected rate %d limit %d", link.Attrs().Name, t.Rate, t.Limit, expected.Rate, expected.Limit)
+		}
+		return nil
+	}
+	return fmt.Errorf("tbf on %s not found", link.Attrs().Name)
+}
+
+func checkMirred(link, ifb netlink.Link) error {
+	filters, err := netlink.FilterList(link, ingressQdisc(link).Handle)
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		u32, ok := filter.(*netlink.U32)
+		if !ok {
+			continue
+		}
+		for _, action := range u32.Actions {
+			if mirred, ok := action.(*netlink.MirredAction); ok && mirred.Ifindex == ifb.Attrs().Index {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("redirect from %s to %s not found", link.Attrs().Name, ifb.Attrs().Name)
+}
+
+func bufferInTicks(rate uint64, burst uint32) uint32 {
+	return time2Tick(uint32(float64(burst) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rate)))
+}
+
+func limitInBytes(rate uint64, latencyInUsec float64, buffer uint32) uint32 {
+	return uint32(float64(rate)*latencyInUsec/float64(netlink.TIME_UNITS_PER_SEC)) + buffer
+}
+
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * netlink.TickInUsec())
+}
@@ -0,0 +1,95 @@
+package bandwidth
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate(nil))
+	require.NoError(t, Validate(&config.Bandwidth{}))
+	require.NoError(t, Validate(&config.Bandwidth{IngressRate: 1000000, IngressBurst: math.MaxInt32}))
+	require.NoError(t, Validate(&config.Bandwidth{EgressRate: 1000000, EgressBurst: 8000}))
+
+	require.Error(t, Validate(&config.Bandwidth{IngressBurst: 8000}))
+	require.Error(t, Validate(&config.Bandwidth{IngressRate: 1000000}))
+	require.Error(t, Validate(&config.Bandwidth{EgressRate: 1000000}))
+	// the burst in bytes has to fit in 32 bits
+	require.Error(t, Validate(&config.Bandwidth{EgressRate: 1000000, EgressBurst: 8 * math.MaxUint32}))
+}
+
+func TestTbf(t *testing.T) {
+	// 1Mbit/s with a 80Kbit burst is 125000 bytes/s with a 10000 bytes burst
+	qdisc := tbf(7, 1000000, 80000)
+	require.Equal(t, 7, qdisc.LinkIndex)
+	require.Equal(t, uint32(netlink.HANDLE_ROOT), qdisc.Parent)
+	require.Equal(t, uint64(125000), qdisc.Rate)
+	// the queue holds the burst and what the rate sends within the latency
+	require.Equal(t, uint32(125000*latencyInMillis/1000+10000), qdisc.Limit)
+	// the bucket drains the burst in 80ms
+	require.Equal(t, uint32(80000*netlink.TickInUsec()), qdisc.Buffer)
+}
+
+func TestIfbName(t *testing.T) {
+	name := IfbName("scni1234567890a")
+	require.LessOrEqual(t, len(name), 15)
+	require.True(t, strings.HasPrefix(name, ifbPrefix))
+	require.Equal(t, name, IfbName("scni1234567890a"))
+	require.NotEqual(t, name, IfbName("scni1234567890b"))
+}
+
+func TestApply(t *testing.T) {
+	testNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testNS.Close()
+
+	err = testNS.Do(func(ns.NetNS) error {
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}))
+		link, err := netlink.LinkByName("veth0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(link))
+
+		bw := &config.Bandwidth{IngressRate: 1000000, IngressBurst: 80000, EgressRate: 2000000, EgressBurst: 160000}
+		require.NoError(t, Apply("veth0", bw))
+		require.NoError(t, Check("veth0", bw))
+		ifb, err := netlink.LinkByName(IfbName("veth0"))
+		require.NoError(t, err)
+		require.NotZero(t, ifb.Attrs().Flags&net.FlagUp)
+
+		require.ErrorIs(t, Check("veth0", &config.Bandwidth{IngressRate: 3000000, IngressBurst: 80000}), IngressMismatchError)
+		require.ErrorIs(t, Check("veth0", &config.Bandwidth{EgressRate: 3000000, EgressBurst: 160000}), EgressMismatchError)
+
+		// the limits are changed in place
+		changed := &config.Bandwidth{IngressRate: 3000000, IngressBurst: 80000, EgressRate: 4000000, EgressBurst: 160000}
+		require.NoError(t, Apply("veth0", changed))
+		require.NoError(t, Check("veth0", changed))
+
+		// removing the egress limit removes the ifb device
+		ingressOnly := &config.Bandwidth{IngressRate: 3000000, IngressBurst: 80000}
+		require.NoError(t, Apply("veth0", ingressOnly))
+		require.NoError(t, Check("veth0", ingressOnly))
+		_, err = netlink.LinkByName(IfbName("veth0"))
+		require.Error(t, err)
+
+		require.NoError(t, Apply("veth0", nil))
+		require.ErrorIs(t, Check("veth0", ingressOnly), IngressMismatchError)
+
+		require.NoError(t, Apply("veth0", bw))
+		require.NoError(t, Teardown("veth0"))
+		_, err = netlink.LinkByName(IfbName("veth0"))
+		require.Error(t, err)
+		// there is nothing left to tear down
+		require.NoError(t, Teardown("veth0"))
+		return nil
+	})
+	require.NoError(t, err)
+}
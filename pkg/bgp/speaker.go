@@ -0,0 +1,351 @@
+// Package bgp runs a BGP speaker for IPv4 unicast on top of the gobgp server. It announces local routes to its peers
+// and learns the best routes the peers announce.
+package bgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	gobgplog "github.com/osrg/gobgp/v3/pkg/log"
+	"github.com/osrg/gobgp/v3/pkg/packet/bgp"
+	"github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	DefaultPort     = 179
+	defaultHoldTime = 90 * time.Second
+)
+
+var ipv4Unicast = &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST}
+
+type Config struct {
+	AS       uint32
+	RouterID net.IP
+	// HoldTime is proposed to the peers, 90s if 0
+	HoldTime time.Duration
+	// ListenAddress and ListenPort accept the passive peers, the speaker doesn't listen if ListenPort is 0
+	ListenAddress net.IP
+	ListenPort    int
+	Log           logr.Logger
+}
+
+type Peer struct {
+	Address net.IP
+	AS      uint32
+	// Port is the port the peer listens on, 179 if 0
+	Port int
+	// Passive peers are only accepted on the listen port, they are never connected to
+	Passive bool
+}
+
+// Route is a prefix and the next hop it's reached through.
+type Route struct {
+	Prefix  *net.IPNet
+	NextHop net.IP
+}
+
+type Speaker struct {
+	conf   Config
+	peers  []Peer
+	server *server.BgpServer
+
+	// mu serializes the changes of the announced routes, so that the server sees them in order
+	mu        sync.Mutex
+	announced map[string]Route
+	// running is true while the server is started, routes are only added to it then
+	running bool
+	updates chan struct{}
+}
+
+func NewSpeaker(conf Config, peers []Peer) (*Speaker, error) {
+	if conf.AS == 0 {
+		return nil, fmt.Errorf("local AS is empty")
+	}
+	if conf.RouterID.To4() == nil {
+		return nil, fmt.Errorf("router id %s isn't an IPv4 address", conf.RouterID)
+	}
+	if conf.HoldTime == 0 {
+		conf.HoldTime = defaultHoldTime
+	}
+	if conf.HoldTime < 3*time.Second || conf.HoldTime > 0xffff*time.Second {
+		return nil, fmt.Errorf("bgp hold time %s is invalid", conf.HoldTime)
+	}
+	for _, peer := range peers {
+		if peer.Address.To4() == nil {
+			return nil, fmt.Errorf("peer address %s isn't an IPv4 address", peer.Address)
+		}
+		if peer.AS == 0 {
+			return nil, fmt.Errorf("AS of peer %s is empty", peer.Address)
+		}
+	}
+	s := &Speaker{
+		conf:      conf,
+		peers:     peers,
+		server:    server.NewBgpServer(server.LoggerOption(&logger{log: conf.Log})),
+		announced: make(map[string]Route),
+		updates:   make(chan struct{}, 1),
+	}
+	go s.server.Serve()
+	return s, nil
+}
+
+// Updates receives a value whenever the learned routes change, several changes may be coalesced into one value.
+func (s *Speaker) Updates() <-chan struct{} {
+	return s.updates
+}
+
+// Announce announces route to every peer, now and on every session established later.
+func (s *Speaker) Announce(route Route) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.announced[route.Prefix.String()] = route
+	if !s.running {
+		return nil
+	}
+	return s.addPath(route)
+}
+
+// Withdraw withdraws the announced route to prefix from every peer.
+func (s *Speaker) Withdraw(prefix *net.IPNet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	route, ok := s.announced[prefix.String()]
+	if !ok {
+		return nil
+	}
+	delete(s.announced, prefix.String())
+	if !s.running {
+		return nil
+	}
+	path, err := newPath(route)
+	if err != nil {
+		return err
+	}
+	return s.server.DeletePath(context.Background(), &api.DeletePathRequest{Family: ipv4Unicast, Path: path})
+}
+
+// Learned returns the best routes learned from the peers sorted by prefix, there are none while the speaker isn't running.
+func (s *Speaker) Learned() ([]Route, error) {
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	if !running {
+		return nil, nil
+	}
+
+	var routes []Route
+	var parseErr error
+	err := s.server.ListPath(context.Background(), &api.ListPathRequest{TableType: api.TableType_GLOBAL, Family: ipv4Unicast},
+		func(destination *api.Destination) {
+			for _, path := range destination.Paths {
+				// the announced routes have no neighbor
+				if !path.Best || net.ParseIP(path.NeighborIp) == nil {
+					continue
+				}
+				route, err := toRoute(destination.Prefix, path)
+				if err != nil {
+					parseErr = err
+					continue
+				}
+				routes = append(routes, route)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Prefix.String() < routes[j].Prefix.String()
+	})
+	return routes, nil
+}
+
+// Run starts the server, connects to the active peers and accepts the passive ones until ctx is done.
+// Sessions that go down are connected again by the server.
+func (s *Speaker) Run(ctx context.Context) error {
+	listenPort := int32(-1)
+	var listenAddresses []string
+	if s.conf.ListenPort != 0 {
+		listenPort = int32(s.conf.ListenPort)
+		if s.conf.ListenAddress != nil {
+			listenAddresses = []string{s.conf.ListenAddress.String()}
+		}
+	}
+	err := s.server.StartBgp(ctx, &api.StartBgpRequest{Global: &api.Global{
+		Asn:             s.conf.AS,
+		RouterId:        s.conf.RouterID.String(),
+		ListenPort:      listenPort,
+		ListenAddresses: listenAddresses,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to start bgp: %v", err)
+	}
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+		_ = s.server.StopBgp(context.Background(), &api.StopBgpRequest{})
+		s.notifyUpdates()
+	}()
+
+	err = s.server.WatchEvent(ctx, &api.WatchEventRequest{Table: &api.WatchEventRequest_Table{
+		Filters: []*api.WatchEventRequest_Table_Filter{{Type: api.WatchEventRequest_Table_Filter_BEST}},
+	}}, func(*api.WatchEventResponse) {
+		s.notifyUpdates()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch bgp routes: %v", err)
+	}
+
+	if err = s.start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// start adds the peers and the routes announced so far to the server.
+func (s *Speaker) start(ctx context.Context) error {
+	for _, peer := range s.peers {
+		if err := s.server.AddPeer(ctx, &api.AddPeerRequest{Peer: s.newPeer(peer)}); err != nil {
+			return fmt.Errorf("failed to add bgp peer %s: %v", peer.Address, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, route := range s.announced {
+		if err := s.addPath(route); err != nil {
+			return err
+		}
+	}
+	s.running = true
+	return nil
+}
+
+func (s *Speaker) newPeer(peer Peer) *api.Peer {
+	holdTime := uint64(s.conf.HoldTime / time.Second)
+	return &api.Peer{
+		Conf: &api.PeerConf{
+			NeighborAddress: peer.Address.String(),
+			PeerAsn:         peer.AS,
+		},
+		Timers: &api.Timers{Config: &api.TimersConfig{
+			HoldTime:          holdTime,
+			KeepaliveInterval: holdTime / 3,
+		}},
+		Transport: &api.Transport{
+			PassiveMode: peer.Passive,
+			RemotePort:  uint32(peer.Port),
+		},
+		AfiSafis: []*api.AfiSafi{{Config: &api.AfiSafiConfig{Family: ipv4Unicast, Enabled: true}}},
+	}
+}
+
+func (s *Speaker) addPath(route Route) error {
+	path, err := newPath(route)
+	if err != nil {
+		return err
+	}
+	if _, err = s.server.AddPath(context.Background(), &api.AddPathRequest{Path: path}); err != nil {
+		return fmt.Errorf("failed to announce %s: %v", route.Prefix, err)
+	}
+	return nil
+}
+
+func (s *Speaker) notifyUpdates() {
+	select {
+	case s.updates <- struct{}{}:
+	default:
+	}
+}
+
+func newPath(route Route) (*api.Path, error) {
+	ones, _ := route.Prefix.Mask.Size()
+	nlri, err := anypb.New(&api.IPAddressPrefix{Prefix: route.Prefix.IP.String(), PrefixLen: uint32(ones)})
+	if err != nil {
+		return nil, err
+	}
+	origin, err := anypb.New(&api.OriginAttribute{Origin: uint32(bgp.BGP_ORIGIN_ATTR_TYPE_IGP)})
+	if err != nil {
+		return nil, err
+	}
+	nextHop, err := anypb.New(&api.NextHopAttribute{NextHop: route.NextHop.String()})
+	if err != nil {
+		return nil, err
+	}
+	return &api.Path{Family: ipv4Unicast, Nlri: nlri, Pattrs: []*anypb.Any{origin, nextHop}}, nil
+}
+
+func toRoute(prefix string, path *api.Path) (Route, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return Route{}, err
+	}
+	attrs, err := apiutil.GetNativePathAttributes(path)
+	if err != nil {
+		return Route{}, err
+	}
+	for _, attr := range attrs {
+		if nextHop, ok := attr.(*bgp.PathAttributeNextHop); ok {
+			return Route{Prefix: ipNet, NextHop: nextHop.Value}, nil
+		}
+	}
+	return Route{}, fmt.Errorf("route to %s has no next hop", prefix)
+}
+
+// logger passes the logs of the gobgp server to a logr.Logger, only errors and warnings are logged by default.
+type logger struct {
+	log logr.Logger
+}
+
+func (l *logger) Panic(msg string, fields gobgplog.Fields) {
+	l.log.Error(nil, msg, keysAndValues(fields)...)
+}
+
+func (l *logger) Fatal(msg string, fields gobgplog.Fields) {
+	l.log.Error(nil, msg, keysAndValues(fields)...)
+}
+
+func (l *logger) Error(msg string, fields gobgplog.Fields) {
+	l.log.Error(nil, msg, keysAndValues(fields)...)
+}
+
+func (l *logger) Warn(msg string, fields gobgplog.Fields) {
+	l.log.Info(msg, keysAndValues(fields)...)
+}
+
+func (l *logger) Info(msg string, fields gobgplog.Fields) {
+	l.log.V(1).Info(msg, keysAndValues(fields)...)
+}
+
+func (l *logger) Debug(msg string, fields gobgplog.Fields) {
+	l.log.V(2).Info(msg, keysAndValues(fields)...)
+}
+
+// SetLevel does nothing, the level is the one of the logr.Logger.
+func (l *logger) SetLevel(gobgplog.LogLevel) {}
+
+func (l *logger) GetLevel() gobgplog.LogLevel {
+	return gobgplog.DebugLevel
+}
+
+func keysAndValues(fields gobgplog.Fields) []interface{} {
+	list := make([]interface{}, 0, 2*len(fields))
+	for key, value := range fields {
+		list = append(list, key, value)
+	}
+	return list
+}
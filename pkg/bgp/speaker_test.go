@@ -0,0 +1,186 @@
+package bgp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+// speakerRoleEnv makes TestSpeaker run one side of the session in a copy of the test binary
+const speakerRoleEnv = "SCNI_BGP_TEST_ROLE"
+
+var (
+	localIP = net.IPv4(10, 0, 0, 1).To4()
+	peerIP  = net.IPv4(10, 0, 0, 2).To4()
+	// eBGP peers replace the next hop with the address of the session
+	localRoute = Route{Prefix: &net.IPNet{IP: net.IPv4(10, 244, 1, 0).To4(), Mask: net.CIDRMask(24, 32)}, NextHop: localIP}
+	peerRoute  = Route{Prefix: &net.IPNet{IP: net.IPv4(10, 244, 2, 0).To4(), Mask: net.CIDRMask(24, 32)}, NextHop: peerIP}
+)
+
+func TestPath(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.244.1.0/24")
+	path, err := newPath(Route{Prefix: prefix, NextHop: net.ParseIP("192.168.0.1")})
+	require.NoError(t, err)
+	route, err := toRoute("10.244.1.0/24", path)
+	require.NoError(t, err)
+	require.Equal(t, prefix.String(), route.Prefix.String())
+	require.True(t, route.NextHop.Equal(net.ParseIP("192.168.0.1")))
+}
+
+// TestSpeaker establishes a session between speakers in two network namespaces connected by a veth pair.
+// The server listens and connects from its own goroutines, which don't stay in a netns, so each speaker runs in a copy
+// of the test binary started in its netns. The server waits 5 to 10 seconds before it connects to a peer for the first time.
+func TestSpeaker(t *testing.T) {
+	switch os.Getenv(speakerRoleEnv) {
+	case "local":
+		runLocalSpeaker(t)
+		return
+	case "peer":
+		runPeerSpeaker(t)
+		return
+	}
+	if testing.Short() {
+		t.Skip("waits for the bgp session to be established")
+	}
+
+	localNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer localNS.Close()
+	peerNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer peerNS.Close()
+
+	err = localNS.Do(func(ns.NetNS) error {
+		return netlink.LinkAdd(&netlink.Veth{
+			LinkAttrs:     netlink.LinkAttrs{Name: "veth0"},
+			PeerName:      "veth1",
+			PeerNamespace: netlink.NsFd(int(peerNS.Fd())),
+		})
+	})
+	require.NoError(t, err)
+	setupLink := func(netNS ns.NetNS, name string, ip net.IP) {
+		err := netNS.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err = netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}}); err != nil {
+				return err
+			}
+			return netlink.LinkSetUp(link)
+		})
+		require.NoError(t, err)
+	}
+	setupLink(localNS, "veth0", localIP)
+	setupLink(peerNS, "veth1", peerIP)
+
+	// a child started from a thread in a netns runs in that netns
+	start := func(netNS ns.NetNS, role string) (*exec.Cmd, *bytes.Buffer) {
+		output := &bytes.Buffer{}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSpeaker$", "-test.v")
+		cmd.Env = append(os.Environ(), speakerRoleEnv+"="+role)
+		cmd.Stdout, cmd.Stderr = output, output
+		require.NoError(t, netNS.Do(func(ns.NetNS) error {
+			return cmd.Start()
+		}))
+		return cmd, output
+	}
+	peer, peerOutput := start(peerNS, "peer")
+	local, localOutput := start(localNS, "local")
+	localErr := local.Wait()
+	peerErr := peer.Wait()
+	require.NoError(t, localErr, localOutput.String())
+	require.NoError(t, peerErr, peerOutput.String())
+}
+
+// runLocalSpeaker connects to the peer, learns its route and checks that the session is kept alive.
+func runLocalSpeaker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	speaker, err := NewSpeaker(Config{AS: 64513, RouterID: localIP, HoldTime: 3 * time.Second},
+		[]Peer{{Address: peerIP, AS: 64512}})
+	require.NoError(t, err)
+	require.NoError(t, speaker.Announce(localRoute))
+	done := make(chan error)
+	go func() { done <- speaker.Run(ctx) }()
+
+	require.Eventually(t, learned(speaker, peerRoute), 20*time.Second, 50*time.Millisecond)
+	require.NoError(t, speaker.Withdraw(localRoute.Prefix))
+
+	// the session is kept alive with keepalives every hold time / 3
+	start := keepalives(speaker)
+	require.NotZero(t, start)
+	require.Eventually(t, func() bool {
+		return keepalives(speaker) >= start+2
+	}, 5*time.Second, 100*time.Millisecond)
+	require.True(t, learned(speaker, peerRoute)())
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	// the peer's routes are dropped with the session
+	routes, err := speaker.Learned()
+	require.NoError(t, err)
+	require.Empty(t, routes)
+}
+
+// runPeerSpeaker accepts the local speaker, learns its route until it's withdrawn and stops after the session is closed.
+func runPeerSpeaker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer, err := NewSpeaker(Config{AS: 64512, RouterID: peerIP, HoldTime: 3 * time.Second, ListenAddress: peerIP, ListenPort: DefaultPort},
+		[]Peer{{Address: localIP, AS: 64513, Passive: true}})
+	require.NoError(t, err)
+	require.NoError(t, peer.Announce(peerRoute))
+	done := make(chan error)
+	go func() { done <- peer.Run(ctx) }()
+
+	require.Eventually(t, learned(peer, localRoute), 20*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return keepalives(peer) > 0 && learned(peer)()
+	}, 10*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return keepalives(peer) == 0
+	}, 30*time.Second, 100*time.Millisecond)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+}
+
+// learned returns whether s has learned exactly the expected routes.
+func learned(s *Speaker, expected ...Route) func() bool {
+	return func() bool {
+		routes, err := s.Learned()
+		if err != nil || len(routes) != len(expected) {
+			return false
+		}
+		for i := range routes {
+			if routes[i].Prefix.String() != expected[i].Prefix.String() || !routes[i].NextHop.Equal(expected[i].NextHop) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// keepalives returns the keepalives s received in its established session, 0 if there is none.
+func keepalives(s *Speaker) uint64 {
+	var received uint64
+	_ = s.server.ListPeer(context.Background(), &api.ListPeerRequest{}, func(p *api.Peer) {
+		if p.State.SessionState == api.PeerState_ESTABLISHED {
+			received = p.State.Messages.Received.Keepalive
+		}
+	})
+	return received
+}
@@ -1,126 +1,551 @@
 package bridge
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
+	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/bandwidth"
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+	"github.com/mayooot/simple-cni-plugin/pkg/tuning"
+)
+
+var (
+	BridgeNotFoundError        = errors.New("bridge not found")
+	BridgeGatewayMissingError  = errors.New("bridge doesn't hold the gateway address")
+	ContainerVethNotFoundError = errors.New("container veth not found")
+	ContainerVethMismatchError = errors.New("container veth doesn't match prevResult")
+	HostVethNotFoundError      = errors.New("host veth not found")
+	HostVethDownError          = errors.New("host veth is down")
+	HostVethNotEnslavedError   = errors.New("host veth is not attached to the bridge")
+	DefaultRouteMissingError   = errors.New("default route via gateway not found")
+	MTUMismatchError           = errors.New("mtu mismatch")
 )
 
-func CreateBridge(bridge string, mtu int, gateway *net.IPNet) (netlink.Link, error) {
-	if l, _ := netlink.LinkByName(bridge); l != nil {
-		return l, nil
+// CreateBridge converges the bridge named bridge to the desired state, creating it if it doesn't exist:
+// a bridge that is up, holds exactly the gateway address, has the mtu and the settings in opts.
+// It returns a description of every correction made to an existing bridge.
+// A bridge created by this call is removed again if it can't be fully set up.
+func CreateBridge(bridge string, mtu int, gateway *net.IPNet, opts *config.BridgeOpts) (_ netlink.Link, corrections []string, err error) {
+	if opts == nil {
+		opts = &config.BridgeOpts{}
 	}
+	dev, err := netlink.LinkByName(bridge)
+	if err != nil && !IsLinkNotFound(err) {
+		return nil, nil, err
+	}
+	created := false
+	if dev == nil {
+		br := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:   bridge,
+				MTU:    mtu,
+				TxQLen: -1,
+			},
+			MulticastSnooping: opts.MulticastSnooping,
+			VlanFiltering:     opts.VlanFiltering,
+		}
+		// another ADD may create the bridge concurrently, only the creator cleans it up
+		err = netlink.LinkAdd(br)
+		if err != nil && !errors.Is(err, syscall.EEXIST) {
+			return nil, nil, err
+		}
+		created = err == nil
+		if dev, err = netlink.LinkByName(bridge); err != nil {
+			return nil, nil, err
+		}
+	}
+	defer func() {
+		if err != nil && created {
+			_ = netlink.LinkDel(dev)
+		}
+	}()
 
-	br := &netlink.Bridge{
-		LinkAttrs: netlink.LinkAttrs{
-			Name:   bridge,
-			MTU:    mtu,
-			TxQLen: -1,
-		},
+	br, ok := dev.(*netlink.Bridge)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s already exists and is a %s", BridgeNotFoundError, bridge, dev.Type())
 	}
-	if err := netlink.LinkAdd(br); err != nil && !errors.Is(err, syscall.EEXIST) {
-		return nil, err
+	correct := func(format string, a ...interface{}) {
+		if !created {
+			corrections = append(corrections, fmt.Sprintf(format, a...))
+		}
 	}
-	dev, err := netlink.LinkByName(bridge)
+
+	if br.Attrs().MTU != mtu {
+		if err = netlink.LinkSetMTU(br, mtu); err != nil {
+			return nil, nil, fmt.Errorf("failed to set mtu of %s: %v", bridge, err)
+		}
+		correct("mtu %d -> %d", br.Attrs().MTU, mtu)
+	}
+	if err = ensureAddr(br, gateway, correct); err != nil {
+		return nil, nil, err
+	}
+	if opts.MulticastSnooping != nil && (br.MulticastSnooping == nil || *br.MulticastSnooping != *opts.MulticastSnooping) {
+		if err = netlink.BridgeSetMcastSnoop(br, *opts.MulticastSnooping); err != nil {
+			return nil, nil, fmt.Errorf("failed to set multicast snooping of %s: %v", bridge, err)
+		}
+		correct("multicast snooping -> %t", *opts.MulticastSnooping)
+	}
+	if opts.VlanFiltering != nil && (br.VlanFiltering == nil || *br.VlanFiltering != *opts.VlanFiltering) {
+		if err = netlink.BridgeSetVlanFiltering(br, *opts.VlanFiltering); err != nil {
+			return nil, nil, fmt.Errorf("failed to set vlan filtering of %s: %v", bridge, err)
+		}
+		correct("vlan filtering -> %t", *opts.VlanFiltering)
+	}
+	// netlink doesn't expose STP, it is set through sysfs
+	if opts.STP != nil {
+		if err = ensureBridgeAttr(bridge, "stp_state", boolAttr(*opts.STP), correct); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.ForwardDelay != nil {
+		// sysfs takes the forward delay in centiseconds
+		if err = ensureBridgeAttr(bridge, "forward_delay", strconv.Itoa(*opts.ForwardDelay*100), correct); err != nil {
+			return nil, nil, err
+		}
+	}
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		if err = netlink.LinkSetUp(br); err != nil {
+			return nil, nil, err
+		}
+		correct("admin state down -> up")
+	}
+	if dev, err = netlink.LinkByName(bridge); err != nil {
+		return nil, nil, err
+	}
+	return dev, corrections, nil
+}
+
+// ensureAddr makes gateway the only IPv4 address of br.
+func ensureAddr(br netlink.Link, gateway *net.IPNet, correct func(string, ...interface{})) error {
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if err = netlink.AddrAdd(dev, &netlink.Addr{IPNet: gateway}); err != nil {
-		return nil, err
+	found := false
+	for _, addr := range addrs {
+		if addr.IPNet.String() == gateway.String() {
+			found = true
+			continue
+		}
+		if err = netlink.AddrDel(br, &addr); err != nil {
+			return fmt.Errorf("failed to delete stale address %s from %s: %v", addr.IPNet, br.Attrs().Name, err)
+		}
+		correct("remove stale address %s", addr.IPNet)
 	}
-	if err = netlink.LinkSetUp(dev); err != nil {
-		return nil, err
+	if !found {
+		if err = netlink.AddrAdd(br, &netlink.Addr{IPNet: gateway}); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add gateway %s to %s: %v", gateway, br.Attrs().Name, err)
+		}
+		correct("add missing gateway %s", gateway)
 	}
-	return dev, nil
+	return nil
 }
 
-func SetupVeth(netNS ns.NetNS, br netlink.Link, mtu int, ifName string, podIP *net.IPNet, gateway net.IP) error {
+func ensureBridgeAttr(bridge, attr, value string, correct func(string, ...interface{})) error {
+	path := filepath.Join("/sys/class/net", bridge, "bridge", attr)
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(current)) == value {
+		return nil
+	}
+	if err = os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set %s of %s: %v", attr, bridge, err)
+	}
+	correct("%s %s -> %s", attr, strings.TrimSpace(string(current)), value)
+	return nil
+}
+
+func boolAttr(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+const (
+	DefaultHostVethPrefix = "veth"
+)
+
+// HostVethName derives the host-side veth name from the container ID and ifName,
+// so that the interface of a pod can be found without a lookup table.
+func HostVethName(prefix, containerID, ifName string) string {
+	if prefix == "" {
+		prefix = DefaultHostVethPrefix
+	}
+	sum := sha256.Sum256([]byte(containerID + "/" + ifName))
+	name := prefix + hex.EncodeToString(sum[:])
+	// linux interface names are at most 15 characters
+	return name[:15]
+}
+
+// MACFromIP derives a locally administered unicast mac address from an IPv4 address, e.g. 10.244.1.2 is 0a:58:0a:f4:01:02.
+func MACFromIP(ip net.IP) (net.HardwareAddr, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+	return net.HardwareAddr{0x0a, 0x58, ip4[0], ip4[1], ip4[2], ip4[3]}, nil
+}
+
+// VethConf describes the veth pair of a container.
+type VethConf struct {
+	IfName string
+	// HostVethName is random if empty
+	HostVethName string
+	// MAC of the container veth, it is random if empty
+	MAC       string
+	MTU       int
+	PodIP     *net.IPNet
+	Gateway   net.IP
+	Bandwidth *config.Bandwidth
+	Port      *config.PortConf
+	// VLAN of the host veth, 0 leaves it untagged, SetupVLAN must have been called for it
+	VLAN   int
+	Tuning *config.TuningConf
+}
+
+// SetupVeth creates a veth pair, configures the container side in netNS and attaches the host side to br.
+// It returns the host-side and container-side interfaces so that they can be reported in the CNI result.
+// If any step fails after the pair is created, the pair is deleted again.
+func SetupVeth(netNS ns.NetNS, br netlink.Link, conf *VethConf) (_ *current.Interface, _ *current.Interface, err error) {
+	hostIface, containerIface, hostVeth, err := createVeth(netNS, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = DelVeth(netNS, conf.IfName, hostIface.Name)
+		}
+	}()
+
+	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+	}
+	if err = setupPort(br, hostVeth, conf.Port); err != nil {
+		return nil, nil, err
+	}
+	if conf.VLAN != 0 {
+		if err = setupVethVLAN(br, hostVeth, conf.VLAN, conf.PodIP.IP); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = bandwidth.Apply(hostIface.Name, conf.Bandwidth); err != nil {
+		return nil, nil, err
+	}
+	return hostIface, containerIface, nil
+}
+
+// createVeth creates a veth pair and configures the container side in netNS, the host side is left unattached.
+// The container gets a link-scoped route to the gateway if the gateway is outside of the pod ip's subnet.
+func createVeth(netNS ns.NetNS, conf *VethConf) (_ *current.Interface, _ *current.Interface, _ netlink.Link, err error) {
+	if err = bandwidth.Validate(conf.Bandwidth); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = tuning.Validate(conf.IfName, conf.Tuning); err != nil {
+		return nil, nil, nil, err
+	}
 	hostIface := &current.Interface{}
-	err := netNS.Do(func(hostNS ns.NetNS) error {
+	containerIface := &current.Interface{}
+	defer func() {
+		// deleting the container veth removes its host-side peer as well
+		if err != nil && hostIface.Name != "" {
+			_ = DelVeth(netNS, conf.IfName, hostIface.Name)
+		}
+	}()
+	// a host veth with the derived name may belong to a running pod whose ADD is retried, so it is never deleted here
+	if conf.HostVethName != "" {
+		if l, _ := netlink.LinkByName(conf.HostVethName); l != nil {
+			return nil, nil, nil, fmt.Errorf("host veth %q: %w", conf.HostVethName, syscall.EEXIST)
+		}
+	}
+	err = netNS.Do(func(hostNS ns.NetNS) error {
 		// create both veth devices and move the host-side veth into the provided hostNS namespace
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		hostVeth, containerVeth, err := ip.SetupVethWithName(conf.IfName, conf.HostVethName, conf.MTU, conf.MAC, hostNS)
 		if err != nil {
 			return err
 		}
 		hostIface.Name = hostVeth.Name
+		hostIface.Mac = hostVeth.HardwareAddr.String()
+		hostIface.Mtu = hostVeth.MTU
+		containerIface.Name = containerVeth.Name
+		containerIface.Mac = containerVeth.HardwareAddr.String()
+		containerIface.Mtu = containerVeth.MTU
+		containerIface.Sandbox = netNS.Path()
 		device, err := netlink.LinkByName(containerVeth.Name)
 		if err != nil {
 			return err
 		}
 		// set ip for container veth
-		if err = netlink.AddrAdd(device, &netlink.Addr{IPNet: podIP}); err != nil {
+		if err = netlink.AddrAdd(device, &netlink.Addr{IPNet: conf.PodIP}); err != nil {
+			return err
+		}
+		// the per-interface sysctls exist as soon as the link does
+		if err = tuning.Apply(device, conf.Tuning); err != nil {
 			return err
 		}
 		// set up the container veth
 		if err = netlink.LinkSetUp(device); err != nil {
 			return err
 		}
+		if !conf.PodIP.Contains(conf.Gateway) {
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: device.Attrs().Index,
+				Dst:       &net.IPNet{IP: conf.Gateway, Mask: net.CIDRMask(32, 32)},
+				Scope:     netlink.SCOPE_LINK,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add route to gateway %s: %v", conf.Gateway, err)
+			}
+		}
 		// add default route, when you run `route -n`, you can see that:
 		// Destination     Gateway         Genmask         Flags Metric Ref    Use Iface
 		// 0.0.0.0         gateway         0.0.0.0         UG    0      0      0   eth0
 		// the eth0 is actually container veth
-		if err = ip.AddDefaultRoute(gateway, device); err != nil {
+		if err = ip.AddDefaultRoute(conf.Gateway, device); err != nil {
 			return err
 		}
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
 	// need to lookup hostVeth again as its index has changed during ns move
 	hostVeth, err := netlink.LinkByName(hostIface.Name)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
+		return nil, nil, nil, fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
 	}
+	return hostIface, containerIface, hostVeth, nil
+}
+
+// DelVeth removes the veth pair of a container, missing interfaces are not an error.
+// The container side ifName is deleted from netNS, netNS may be nil when the netns is already gone.
+// The host side is found by hostVeth, the name recorded at ADD, or by the peer index of the container side,
+// and is deleted too in case it outlived its peer.
+func DelVeth(netNS ns.NetNS, ifName, hostVeth string) error {
+	if netNS != nil {
+		peerIndex := 0
+		err := netNS.Do(func(ns.NetNS) error {
+			device, err := netlink.LinkByName(ifName)
+			if err != nil {
+				if IsLinkNotFound(err) {
+					return nil
+				}
+				return err
+			}
+			if veth, ok := device.(*netlink.Veth); ok {
+				peerIndex, _ = netlink.VethPeerIndex(veth)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// resolve the peer before the pair is deleted, its index may be reused afterward
+		if hostVeth == "" && peerIndex > 0 {
+			if peer, err := netlink.LinkByIndex(peerIndex); err == nil {
+				hostVeth = peer.Attrs().Name
+			}
+		}
 
-	if hostVeth == nil {
-		return fmt.Errorf("nil hostveth")
+		err = netNS.Do(func(ns.NetNS) error {
+			device, err := netlink.LinkByName(ifName)
+			if err != nil {
+				if IsLinkNotFound(err) {
+					return nil
+				}
+				return err
+			}
+			return ignoreLinkNotFound(netlink.LinkDel(device))
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
-		return fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+	if hostVeth == "" {
+		return nil
 	}
-	return nil
+	if err := bandwidth.Teardown(hostVeth); err != nil {
+		return err
+	}
+	device, err := netlink.LinkByName(hostVeth)
+	if err != nil {
+		if IsLinkNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return ignoreLinkNotFound(netlink.LinkDel(device))
 }
 
-func DelVeth(netNS ns.NetNS, ifName string) error {
-	return netNS.Do(func(ns.NetNS) error {
-		device, err := netlink.LinkByName(ifName)
-		if err != nil {
-			if os.IsNotExist(err) {
-				return nil
-			}
+// IsLinkNotFound reports whether err means that the link doesn't exist.
+func IsLinkNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound) || errors.Is(err, syscall.ENODEV)
+}
+
+func ignoreLinkNotFound(err error) error {
+	if err != nil && IsLinkNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// CheckBridge validates that bridge exists, holds the gateway address and has the expected mtu.
+func CheckBridge(bridge string, mtu int, gateway *net.IPNet) error {
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		if IsLinkNotFound(err) {
+			return fmt.Errorf("%w: %s", BridgeNotFoundError, bridge)
+		}
+		return err
+	}
+	if _, ok := br.(*netlink.Bridge); !ok {
+		return fmt.Errorf("%w: %s is a %s", BridgeNotFoundError, bridge, br.Type())
+	}
+	if br.Attrs().MTU != mtu {
+		return fmt.Errorf("%w: bridge %s has mtu %d, expected %d", MTUMismatchError, bridge, br.Attrs().MTU, mtu)
+	}
+
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IPNet.String() == gateway.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s on %s", BridgeGatewayMissingError, gateway, bridge)
+}
+
+// CheckConf is the expected state of a container's veth pair.
+type CheckConf struct {
+	Bridge   string
+	MTU      int
+	IfName   string
+	HostVeth string
+	Gateway  net.IP
+
+	Bandwidth *config.Bandwidth
+	Port      *config.PortConf
+	VLAN      int
+	Tuning    *config.TuningConf
+
+	// what prevResult reported for the container interface
+	ContIface *current.Interface
+	IPs       []*current.IPConfig
+	Routes    []*types.Route
+}
+
+// CheckVeth validates both sides of a container's veth pair, each kind of drift is reported by a distinct error.
+func CheckVeth(netNS ns.NetNS, conf *CheckConf) error {
+	hostVeth, err := checkVethPair(netNS, conf)
+	if err != nil {
+		return err
+	}
+	br, err := netlink.LinkByName(conf.Bridge)
+	if err != nil {
+		return err
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("%w: %s is not attached to %s", HostVethNotEnslavedError, conf.HostVeth, conf.Bridge)
+	}
+	if err = checkPort(br, hostVeth, conf.Port); err != nil {
+		return err
+	}
+	if conf.VLAN != 0 {
+		if err = checkVethVLAN(conf.Bridge, hostVeth, conf.VLAN, conf.IPs); err != nil {
 			return err
 		}
-		return netlink.LinkDel(device)
-	})
+	}
+	return bandwidth.Check(conf.HostVeth, conf.Bandwidth)
 }
 
-func CheckVeth(netNS ns.NetNS, ifName string, ip net.IP) error {
-	return netNS.Do(func(ns.NetNS) error {
-		device, err := netlink.LinkByName(ifName)
+// checkVethPair validates the container side of a container's veth pair and that its host-side peer is up
+// and has the expected name and mtu, it returns the host-side peer.
+func checkVethPair(netNS ns.NetNS, conf *CheckConf) (netlink.Link, error) {
+	peerIndex := 0
+	err := netNS.Do(func(ns.NetNS) error {
+		device, err := netlink.LinkByName(conf.IfName)
 		if err != nil {
+			if IsLinkNotFound(err) {
+				return fmt.Errorf("%w: %s", ContainerVethNotFoundError, conf.IfName)
+			}
 			return err
 		}
+		veth, ok := device.(*netlink.Veth)
+		if !ok {
+			return fmt.Errorf("%w: %s is a %s", ContainerVethNotFoundError, conf.IfName, device.Type())
+		}
+		if peerIndex, err = netlink.VethPeerIndex(veth); err != nil {
+			return err
+		}
+		if conf.ContIface.Mac != "" && conf.ContIface.Mac != device.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("%w: %s has mac %s, expected %s", ContainerVethMismatchError, conf.IfName, device.Attrs().HardwareAddr, conf.ContIface.Mac)
+		}
+		if device.Attrs().MTU != conf.MTU {
+			return fmt.Errorf("%w: %s has mtu %d, expected %d", MTUMismatchError, conf.IfName, device.Attrs().MTU, conf.MTU)
+		}
+		if err = ip.ValidateExpectedInterfaceIPs(conf.IfName, conf.IPs); err != nil {
+			return fmt.Errorf("%w: %v", ContainerVethMismatchError, err)
+		}
 
-		// get IPv4 address only
-		ips, err := netlink.AddrList(device, netlink.FAMILY_V4)
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: device.Attrs().Index}, netlink.RT_FILTER_OIF)
 		if err != nil {
 			return err
 		}
-		for _, addr := range ips {
-			if addr.IP.Equal(ip) {
-				return nil
+		found := false
+		for _, route := range routes {
+			if (route.Dst == nil || route.Dst.IP.IsUnspecified()) && route.Gw.Equal(conf.Gateway) {
+				found = true
+				break
 			}
 		}
-		return fmt.Errorf("failed to find ip %s for %s", ip, ifName)
+		if !found {
+			return fmt.Errorf("%w: %s", DefaultRouteMissingError, conf.Gateway)
+		}
+		if err = ip.ValidateExpectedRoute(conf.Routes); err != nil {
+			return fmt.Errorf("%w: %v", ContainerVethMismatchError, err)
+		}
+		return tuning.Check(device, conf.Tuning)
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		if IsLinkNotFound(err) {
+			return nil, fmt.Errorf("%w: peer index %d of %s", HostVethNotFoundError, peerIndex, conf.IfName)
+		}
+		return nil, err
+	}
+	if hostVeth.Attrs().Name != conf.HostVeth {
+		return nil, fmt.Errorf("%w: peer of %s is %s, expected %s", HostVethNotFoundError, conf.IfName, hostVeth.Attrs().Name, conf.HostVeth)
+	}
+	if hostVeth.Attrs().Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("%w: %s", HostVethDownError, conf.HostVeth)
+	}
+	if hostVeth.Attrs().MTU != conf.MTU {
+		return nil, fmt.Errorf("%w: %s has mtu %d, expected %d", MTUMismatchError, conf.HostVeth, hostVeth.Attrs().MTU, conf.MTU)
+	}
+	return hostVeth, nil
 }
@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestHostVethName(t *testing.T) {
+	name := HostVethName("", "container", "eth0")
+	require.Len(t, name, 15)
+	require.Equal(t, DefaultHostVethPrefix, name[:len(DefaultHostVethPrefix)])
+	require.Equal(t, name, HostVethName("veth", "container", "eth0"))
+
+	require.NotEqual(t, name, HostVethName("", "container", "eth1"))
+	require.NotEqual(t, name, HostVethName("", "other", "eth0"))
+	require.Equal(t, "scni", HostVethName("scni", "container", "eth0")[:4])
+}
+
+func TestMACFromIP(t *testing.T) {
+	mac, err := MACFromIP(net.ParseIP("10.244.1.2"))
+	require.NoError(t, err)
+	require.Equal(t, "0a:58:0a:f4:01:02", mac.String())
+
+	_, err = MACFromIP(net.ParseIP("fd00::1"))
+	require.Error(t, err)
+}
+
+func TestSetupVethExists(t *testing.T) {
+	hostNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer hostNS.Close()
+	containerNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer containerNS.Close()
+
+	err = hostNS.Do(func(ns.NetNS) error {
+		br, _, err := CreateBridge("cni0", 1500, &net.IPNet{IP: net.IPv4(10, 244, 1, 1), Mask: net.CIDRMask(24, 32)}, nil)
+		require.NoError(t, err)
+		conf := &VethConf{
+			IfName:       "eth0",
+			HostVethName: HostVethName("", "container", "eth0"),
+			MTU:          1500,
+			PodIP:        &net.IPNet{IP: net.IPv4(10, 244, 1, 2), Mask: net.CIDRMask(24, 32)},
+			Gateway:      net.IPv4(10, 244, 1, 1),
+		}
+		hostIface, _, err := SetupVeth(containerNS, br, conf)
+		require.NoError(t, err)
+
+		// a retried ADD of the same container must not touch the running pod's veth
+		_, _, err = SetupVeth(containerNS, br, conf)
+		require.True(t, errors.Is(err, syscall.EEXIST), "%v", err)
+		hostVeth, err := netlink.LinkByName(hostIface.Name)
+		require.NoError(t, err)
+		require.Equal(t, hostIface.Mac, hostVeth.Attrs().HardwareAddr.String())
+		require.NoError(t, containerNS.Do(func(ns.NetNS) error {
+			_, err := netlink.LinkByName("eth0")
+			return err
+		}))
+		return nil
+	})
+	require.NoError(t, err)
+}
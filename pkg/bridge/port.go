@@ -0,0 +1,89 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+var PortMismatchError = errors.New("bridge port settings don't match")
+
+// setupPort applies the port settings to hostVeth, which is already attached to br.
+func setupPort(br, hostVeth netlink.Link, port *config.PortConf) error {
+	if port == nil {
+		return nil
+	}
+	name := hostVeth.Attrs().Name
+	if port.PromiscMode {
+		if err := netlink.SetPromiscOn(br); err != nil {
+			return fmt.Errorf("failed to set promisc on bridge %s: %v", br.Attrs().Name, err)
+		}
+	}
+	if port.HairpinMode {
+		if err := netlink.LinkSetHairpin(hostVeth, true); err != nil {
+			return fmt.Errorf("failed to set hairpin mode on %s: %v", name, err)
+		}
+	}
+	if port.MACLearning != nil {
+		if err := netlink.LinkSetLearning(hostVeth, *port.MACLearning); err != nil {
+			return fmt.Errorf("failed to set learning on %s: %v", name, err)
+		}
+	}
+	if port.UnicastFlood != nil {
+		if err := netlink.LinkSetFlood(hostVeth, *port.UnicastFlood); err != nil {
+			return fmt.Errorf("failed to set unicast flood on %s: %v", name, err)
+		}
+	}
+	if port.PortIsolation {
+		// netlink doesn't support IFLA_BRPORT_ISOLATED yet
+		if err := os.WriteFile(brportPath(name, "isolated"), []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to set isolation on %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkPort verifies the port settings of hostVeth.
+func checkPort(br, hostVeth netlink.Link, port *config.PortConf) error {
+	if port == nil {
+		return nil
+	}
+	name := hostVeth.Attrs().Name
+	if port.PromiscMode && br.Attrs().Promisc == 0 {
+		return fmt.Errorf("%w: bridge %s is not promiscuous", PortMismatchError, br.Attrs().Name)
+	}
+
+	protinfo, err := netlink.LinkGetProtinfo(hostVeth)
+	if err != nil {
+		return err
+	}
+	if port.HairpinMode && !protinfo.Hairpin {
+		return fmt.Errorf("%w: hairpin mode of %s is off", PortMismatchError, name)
+	}
+	if port.MACLearning != nil && protinfo.Learning != *port.MACLearning {
+		return fmt.Errorf("%w: learning of %s is %t, expected %t", PortMismatchError, name, protinfo.Learning, *port.MACLearning)
+	}
+	if port.UnicastFlood != nil && protinfo.Flood != *port.UnicastFlood {
+		return fmt.Errorf("%w: unicast flood of %s is %t, expected %t", PortMismatchError, name, protinfo.Flood, *port.UnicastFlood)
+	}
+	if port.PortIsolation {
+		isolated, err := os.ReadFile(brportPath(name, "isolated"))
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(isolated)) != "1" {
+			return fmt.Errorf("%w: %s is not isolated", PortMismatchError, name)
+		}
+	}
+	return nil
+}
+
+func brportPath(ifName, attr string) string {
+	return filepath.Join("/sys/class/net", ifName, "brport", attr)
+}
@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/bandwidth"
+)
+
+// RoutedGateway is the gateway of every pod in routed mode, the host veth answers ARP for it by proxy ARP.
+// It never exists on the host, so all pods can share it.
+var RoutedGateway = net.IPv4(169, 254, 1, 1)
+
+var (
+	ProxyARPDisabledError = errors.New("proxy arp is disabled on host veth")
+	HostRouteMissingError = errors.New("host route to pod not found")
+)
+
+// SetupRoutedVeth creates a veth pair without a bridge: the container gets conf.PodIP, which should be a /32,
+// with a link-scoped route to conf.Gateway, and the host routes the pod ip to the host veth, which
+// answers ARP for the gateway. Pods on the node can only reach each other through the host routes.
+// If any step fails after the pair is created, the pair is deleted again.
+func SetupRoutedVeth(netNS ns.NetNS, conf *VethConf) (_ *current.Interface, _ *current.Interface, err error) {
+	hostIface, containerIface, hostVeth, err := createVeth(netNS, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the host route is removed together with the host veth
+	defer func() {
+		if err != nil {
+			_ = DelVeth(netNS, conf.IfName, hostIface.Name)
+		}
+	}()
+
+	name := hostVeth.Attrs().Name
+	if _, err = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", name), "1"); err != nil {
+		return nil, nil, fmt.Errorf("failed to enable proxy arp on %s: %v", name, err)
+	}
+	// answer immediately instead of after a random delay
+	if _, err = sysctl.Sysctl(fmt.Sprintf("net/ipv4/neigh/%s/proxy_delay", name), "0"); err != nil {
+		return nil, nil, fmt.Errorf("failed to set proxy delay on %s: %v", name, err)
+	}
+	err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: hostVeth.Attrs().Index,
+		Dst:       &net.IPNet{IP: conf.PodIP.IP, Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to add route to %s via %s: %v", conf.PodIP.IP, name, err)
+	}
+	if err = bandwidth.Apply(name, conf.Bandwidth); err != nil {
+		return nil, nil, err
+	}
+	return hostIface, containerIface, nil
+}
+
+// CheckRoutedVeth validates both sides of a container's veth pair in routed mode, conf.Bridge is ignored.
+func CheckRoutedVeth(netNS ns.NetNS, conf *CheckConf) error {
+	hostVeth, err := checkVethPair(netNS, conf)
+	if err != nil {
+		return err
+	}
+	proxyARP, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", conf.HostVeth))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(proxyARP) != "1" {
+		return fmt.Errorf("%w: %s", ProxyARPDisabledError, conf.HostVeth)
+	}
+	for _, ipc := range conf.IPs {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+			LinkIndex: hostVeth.Attrs().Index,
+			Dst:       &net.IPNet{IP: ipc.Address.IP, Mask: net.CIDRMask(32, 32)},
+		}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST)
+		if err != nil {
+			return err
+		}
+		if len(routes) == 0 {
+			return fmt.Errorf("%w: %s via %s", HostRouteMissingError, ipc.Address.IP, conf.HostVeth)
+		}
+	}
+	return bandwidth.Check(conf.HostVeth, conf.Bandwidth)
+}
@@ -0,0 +1,207 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+)
+
+// a new bridge port is an untagged member of VLAN 1
+const defaultPVID = 1
+
+var VLANMismatchError = errors.New("vlan doesn't match")
+
+// VLANIfName returns the name of the VLAN sub-interface of parent.
+func VLANIfName(parent string, vlan int) (string, error) {
+	name := fmt.Sprintf("%s.%d", parent, vlan)
+	if len(name) > 15 {
+		return "", fmt.Errorf("vlan interface name %s is longer than 15 characters", name)
+	}
+	return name, nil
+}
+
+// SetupVLAN makes the VLAN-aware bridge br carry vlan and returns the gateway interface of the VLAN.
+// The bridge itself only routes for the untagged VLAN, so every VLAN gets a sub-interface of br
+// that holds the gateway as a /32, the routes to the pods of the VLAN are added per pod.
+// If uplink isn't empty, a sub-interface of it is attached to br to carry the VLAN off the node.
+func SetupVLAN(br netlink.Link, vlan int, gateway net.IP, uplink string) (netlink.Link, error) {
+	if err := netlink.BridgeVlanAdd(br, uint16(vlan), false, false, true, false); err != nil {
+		return nil, fmt.Errorf("failed to add vlan %d to bridge %s: %v", vlan, br.Attrs().Name, err)
+	}
+	gwLink, err := ensureVLANLink(br, vlan)
+	if err != nil {
+		return nil, err
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: gateway, Mask: net.CIDRMask(32, 32)}}
+	if err = netlink.AddrAdd(gwLink, addr); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return nil, fmt.Errorf("failed to add gateway %s to %s: %v", gateway, gwLink.Attrs().Name, err)
+	}
+	if err = netlink.LinkSetUp(gwLink); err != nil {
+		return nil, err
+	}
+
+	if uplink == "" {
+		return gwLink, nil
+	}
+	uplinkLink, err := netlink.LinkByName(uplink)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find vlan uplink %s: %v", uplink, err)
+	}
+	sub, err := ensureVLANLink(uplinkLink, vlan)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Attrs().MasterIndex != br.Attrs().Index {
+		if err = netlink.LinkSetMaster(sub, br); err != nil {
+			return nil, fmt.Errorf("failed to attach %s to bridge %s: %v", sub.Attrs().Name, br.Attrs().Name, err)
+		}
+	}
+	// the sub-interface tags what leaves through it, so it is an untagged member of the VLAN on the bridge
+	if err = setupPortVLAN(sub, vlan); err != nil {
+		return nil, err
+	}
+	if err = netlink.LinkSetUp(sub); err != nil {
+		return nil, err
+	}
+	return gwLink, nil
+}
+
+// ensureVLANLink returns the VLAN sub-interface of parent, creating it if it doesn't exist.
+func ensureVLANLink(parent netlink.Link, vlan int) (netlink.Link, error) {
+	name, err := VLANIfName(parent.Attrs().Name, vlan)
+	if err != nil {
+		return nil, err
+	}
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		if v, ok := link.(*netlink.Vlan); !ok || v.VlanId != vlan || v.ParentIndex != parent.Attrs().Index {
+			return nil, fmt.Errorf("%w: %s already exists and isn't vlan %d of %s", VLANMismatchError, name, vlan, parent.Attrs().Name)
+		}
+		return link, nil
+	}
+	if !IsLinkNotFound(err) {
+		return nil, err
+	}
+	err = netlink.LinkAdd(&netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: parent.Attrs().Index,
+		},
+		VlanId: vlan,
+	})
+	// another ADD may create it concurrently
+	if err != nil && !errors.Is(err, syscall.EEXIST) {
+		return nil, fmt.Errorf("failed to create vlan interface %s: %v", name, err)
+	}
+	return netlink.LinkByName(name)
+}
+
+// setupPortVLAN makes vlan the only, untagged VLAN of the bridge port link.
+func setupPortVLAN(link netlink.Link, vlan int) error {
+	if vlan != defaultPVID {
+		if err := netlink.BridgeVlanDel(link, defaultPVID, true, true, false, true); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to remove the default vlan of %s: %v", link.Attrs().Name, err)
+		}
+	}
+	if err := netlink.BridgeVlanAdd(link, uint16(vlan), true, true, false, true); err != nil {
+		return fmt.Errorf("failed to add vlan %d to %s: %v", vlan, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// setupVethVLAN puts hostVeth into vlan and routes the pod ip through the gateway interface of the VLAN.
+func setupVethVLAN(br, hostVeth netlink.Link, vlan int, podIP net.IP) error {
+	if err := setupPortVLAN(hostVeth, vlan); err != nil {
+		return err
+	}
+	gwName, err := VLANIfName(br.Attrs().Name, vlan)
+	if err != nil {
+		return err
+	}
+	gwLink, err := netlink.LinkByName(gwName)
+	if err != nil {
+		return fmt.Errorf("failed to find the gateway interface of vlan %d: %v", vlan, err)
+	}
+	return addPodRoute(gwLink, podIP)
+}
+
+// checkVethVLAN verifies that hostVeth is in vlan and the pod ips are routed through the gateway interface of the VLAN.
+func checkVethVLAN(bridge string, hostVeth netlink.Link, vlan int, ips []*current.IPConfig) error {
+	if err := checkPortVLAN(hostVeth, vlan); err != nil {
+		return err
+	}
+	gwName, err := VLANIfName(bridge, vlan)
+	if err != nil {
+		return err
+	}
+	for _, ipc := range ips {
+		if err = checkPodRoute(gwName, ipc.Address.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPortVLAN verifies that vlan is the untagged PVID of the bridge port link.
+func checkPortVLAN(link netlink.Link, vlan int) error {
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return err
+	}
+	for _, info := range vlans[int32(link.Attrs().Index)] {
+		if info.PortVID() {
+			if int(info.Vid) != vlan || !info.EngressUntag() {
+				return fmt.Errorf("%w: pvid of %s is %s, expected %d untagged", VLANMismatchError, link.Attrs().Name, info, vlan)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s has no pvid, expected %d", VLANMismatchError, link.Attrs().Name, vlan)
+}
+
+// addPodRoute routes the pod ip through the gateway interface of its VLAN.
+func addPodRoute(gwLink netlink.Link, podIP net.IP) error {
+	err := netlink.RouteReplace(&netlink.Route{
+		LinkIndex: gwLink.Attrs().Index,
+		Dst:       &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add route to %s via %s: %v", podIP, gwLink.Attrs().Name, err)
+	}
+	return nil
+}
+
+// DelPodRoute removes the route to a pod in a VLAN, it succeeds if there is none.
+func DelPodRoute(podIP net.IP) error {
+	err := netlink.RouteDel(&netlink.Route{
+		Dst:   &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)},
+		Scope: netlink.SCOPE_LINK,
+	})
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to delete route to %s: %v", podIP, err)
+	}
+	return nil
+}
+
+// checkPodRoute verifies that the pod ip is routed through the gateway interface of its VLAN.
+func checkPodRoute(gwName string, podIP net.IP) error {
+	routes, err := netlink.RouteGet(podIP)
+	if err != nil {
+		return err
+	}
+	gwLink, err := netlink.LinkByName(gwName)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", VLANMismatchError, gwName, err)
+	}
+	for _, route := range routes {
+		if route.LinkIndex == gwLink.Attrs().Index {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s isn't routed through %s", VLANMismatchError, podIP, gwName)
+}
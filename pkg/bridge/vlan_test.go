@@ -0,0 +1,100 @@
+package bridge
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+func TestVLANIfName(t *testing.T) {
+	tests := []struct {
+		name    string
+		parent  string
+		vlan    int
+		want    string
+		wantErr bool
+	}{
+		{name: "bridge", parent: "cni0", vlan: 100, want: "cni0.100"},
+		{name: "highest vlan", parent: "cni0", vlan: 4094, want: "cni0.4094"},
+		{name: "15 characters", parent: "enp129s0f1", vlan: 4094, want: "enp129s0f1.4094"},
+		{name: "too long", parent: "enp129s0f1np1", vlan: 100, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := VLANIfName(tt.parent, tt.vlan)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, name)
+		})
+	}
+}
+
+func TestVethVLAN(t *testing.T) {
+	hostNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer hostNS.Close()
+	containerNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer containerNS.Close()
+
+	vlanFiltering := true
+	gateway := net.IPv4(10, 244, 1, 1)
+	var br netlink.Link
+	err = hostNS.Do(func(ns.NetNS) error {
+		br, _, err = CreateBridge("cni0", 1500, &net.IPNet{IP: gateway, Mask: net.CIDRMask(24, 32)},
+			&config.BridgeOpts{VlanFiltering: &vlanFiltering})
+		return err
+	})
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("the kernel has no VLAN-aware bridge support")
+	}
+	require.NoError(t, err)
+
+	err = hostNS.Do(func(ns.NetNS) error {
+		gwLink, err := SetupVLAN(br, 100, gateway, "")
+		require.NoError(t, err)
+		require.Equal(t, "cni0.100", gwLink.Attrs().Name)
+		// setting up the VLAN again for the next pod succeeds
+		_, err = SetupVLAN(br, 100, gateway, "")
+		require.NoError(t, err)
+
+		podIP := &net.IPNet{IP: net.IPv4(10, 244, 1, 2), Mask: net.CIDRMask(24, 32)}
+		hostIface, _, err := SetupVeth(containerNS, br, &VethConf{
+			IfName:       "eth0",
+			HostVethName: HostVethName("", "container", "eth0"),
+			MTU:          1500,
+			PodIP:        podIP,
+			Gateway:      gateway,
+			VLAN:         100,
+		})
+		require.NoError(t, err)
+		hostVeth, err := netlink.LinkByName(hostIface.Name)
+		require.NoError(t, err)
+
+		ips := []*current.IPConfig{{Address: *podIP}}
+		require.NoError(t, checkVethVLAN("cni0", hostVeth, 100, ips))
+		require.ErrorIs(t, checkPortVLAN(hostVeth, 200), VLANMismatchError)
+
+		// the pod route outlives the veth until it is deleted
+		require.NoError(t, DelVeth(containerNS, "eth0", hostIface.Name))
+		require.NoError(t, checkPodRoute("cni0.100", podIP.IP))
+		require.NoError(t, DelPodRoute(podIP.IP))
+		require.ErrorIs(t, checkPodRoute("cni0.100", podIP.IP), VLANMismatchError)
+		require.NoError(t, DelPodRoute(podIP.IP))
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -3,19 +3,43 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
 )
 
 const (
 	DefaultSubnetFile = "/run/simple-cni-plugin/subnet.json"
 	DefaultBridgeName = "cni0"
+	DefaultMTU        = 1500
+	// MaxHostVethPrefixLen leaves room for enough hash characters to keep host veth names unique
+	MaxHostVethPrefixLen = 7
+	MaxVLAN              = 4094
+
+	// ModeBridge attaches pods to the bridge
+	ModeBridge = "bridge"
+	// ModeRouted gives pods a /32 and routes them point-to-point through their host veth, there is no bridge
+	ModeRouted = "routed"
+	// ModeMacvlan and ModeIPvlan attach pods to the Master NIC with a macvlan or ipvlan sub-interface
+	ModeMacvlan = "macvlan"
+	ModeIPvlan  = "ipvlan"
+
+	IPvlanModeL2 = "l2"
+	IPvlanModeL3 = "l3"
 )
 
 type SubnetConf struct {
 	Subnet string `json:"subnet"`
 	Bridge string `json:"bridge"`
+	// MTU is derived by the daemonset from the host uplink
+	MTU int `json:"mtu,omitempty"`
+	// DatapathMode is the mode of the daemonset, the network config may leave it out
+	DatapathMode string `json:"mode,omitempty"`
 }
 
 func LoadSubnetConfig() (*SubnetConf, error) {
@@ -41,6 +65,216 @@ func StoreSubnetConfig(conf *SubnetConf) error {
 	return os.WriteFile(DefaultSubnetFile, data, 0644)
 }
 
+// PortMapping is an entry of the portMappings capability, i.e. a hostPort of a pod.
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// Bandwidth is an entry of the bandwidth capability, rates are in bits per second and bursts in bits.
+type Bandwidth struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+// LogConf configures the log file of the plugin.
+type LogConf struct {
+	File  string `json:"file,omitempty"`
+	Level string `json:"level,omitempty"` // debug, info or error
+}
+
+// TuningConf tunes the container veth, settings that aren't set are left as they are.
+type TuningConf struct {
+	// Sysctl is applied in the container netns, only allowlisted keys are accepted
+	Sysctl            map[string]string `json:"sysctl,omitempty"`
+	TxQueueLen        *int              `json:"txQueueLen,omitempty"`
+	TxChecksumOffload *bool             `json:"txChecksumOffload,omitempty"`
+}
+
+// merge returns c with the settings of o on top.
+func (c *TuningConf) merge(o *TuningConf) *TuningConf {
+	merged := &TuningConf{}
+	for _, conf := range []*TuningConf{c, o} {
+		if conf == nil {
+			continue
+		}
+		for key, value := range conf.Sysctl {
+			if merged.Sysctl == nil {
+				merged.Sysctl = make(map[string]string)
+			}
+			merged.Sysctl[key] = value
+		}
+		if conf.TxQueueLen != nil {
+			merged.TxQueueLen = conf.TxQueueLen
+		}
+		if conf.TxChecksumOffload != nil {
+			merged.TxChecksumOffload = conf.TxChecksumOffload
+		}
+	}
+	return merged
+}
+
+// ConfArgs is args.cni of the network config.
+type ConfArgs struct {
+	IPs []string `json:"ips,omitempty"`
+	MAC string   `json:"mac,omitempty"`
+}
+
+// K8sArgs is CNI_ARGS, which kubelet fills with the pod's identity.
+// Unknown args are an error unless IgnoreUnknown=1 is passed as well, kubelet always passes it.
+type K8sArgs struct {
+	types.CommonArgs
+
+	IP                         net.IP
+	MAC                        types.UnmarshallableString
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
+
+	// SYSCTL is a comma separated list of key:value, CNI_ARGS values can't contain "="
+	SYSCTL              types.UnmarshallableString
+	TXQUEUELEN          types.UnmarshallableString
+	TX_CHECKSUM_OFFLOAD types.UnmarshallableString
+}
+
+// tuning returns the tuning settings of CNI_ARGS.
+func (a *K8sArgs) tuning() (*TuningConf, error) {
+	conf := &TuningConf{}
+	if a.SYSCTL != "" {
+		conf.Sysctl = make(map[string]string)
+		for _, pair := range strings.Split(string(a.SYSCTL), ",") {
+			key, value, ok := strings.Cut(pair, ":")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("invalid SYSCTL %q, expected key:value", pair)
+			}
+			conf.Sysctl[key] = value
+		}
+	}
+	if a.TXQUEUELEN != "" {
+		qlen, err := strconv.Atoi(string(a.TXQUEUELEN))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TXQUEUELEN %q: %v", a.TXQUEUELEN, err)
+		}
+		conf.TxQueueLen = &qlen
+	}
+	if a.TX_CHECKSUM_OFFLOAD != "" {
+		offload, err := strconv.ParseBool(string(a.TX_CHECKSUM_OFFLOAD))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TX_CHECKSUM_OFFLOAD %q: %v", a.TX_CHECKSUM_OFFLOAD, err)
+		}
+		conf.TxChecksumOffload = &offload
+	}
+	return conf, nil
+}
+
+func LoadK8sArgs(args string) (*K8sArgs, error) {
+	k8sArgs := &K8sArgs{}
+	if err := types.LoadArgs(args, k8sArgs); err != nil {
+		return nil, fmt.Errorf("failed to parse CNI_ARGS: %v", err)
+	}
+	return k8sArgs, nil
+}
+
+// LoadK8sArgsLenient is LoadK8sArgs that drops the args it can't parse instead of failing,
+// for DEL, which must clean up whatever the runtime passes.
+func LoadK8sArgsLenient(args string) *K8sArgs {
+	k8sArgs := &K8sArgs{}
+	for _, pair := range strings.Split(args, ";") {
+		if pair == "" {
+			continue
+		}
+		// each pair is parsed on its own, so that a malformed one doesn't drop the others
+		_ = types.LoadArgs(pair+";IgnoreUnknown=1", k8sArgs)
+	}
+	return k8sArgs
+}
+
+// PodName returns namespace/name of the pod, or "" if it isn't a kubernetes pod.
+func (a *K8sArgs) PodName() string {
+	if a.K8S_POD_NAME == "" {
+		return ""
+	}
+	return string(a.K8S_POD_NAMESPACE) + "/" + string(a.K8S_POD_NAME)
+}
+
+// RequestedMAC returns the mac of the container veth requested by the mac capability, CNI_ARGS MAC or
+// args.cni.mac of the network config, in that order of precedence. It returns "" if none is requested.
+func (c *PluginConf) RequestedMAC(k8sArgs *K8sArgs) (string, error) {
+	mac := c.RuntimeConfig.MAC
+	if mac == "" && k8sArgs != nil {
+		mac = string(k8sArgs.MAC)
+	}
+	if mac == "" && c.Args != nil && c.Args.A != nil {
+		mac = c.Args.A.MAC
+	}
+	if mac == "" {
+		return "", nil
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("invalid mac %q: %v", mac, err)
+	}
+	return hw.String(), nil
+}
+
+// RequestedTuning merges the tuning settings of the network config, CNI_ARGS and the tuning runtimeConfig,
+// in increasing order of precedence. Sysctls are merged key by key.
+func (c *PluginConf) RequestedTuning(k8sArgs *K8sArgs) (*TuningConf, error) {
+	tuning := c.Tuning.merge(nil)
+	if k8sArgs != nil {
+		argsTuning, err := k8sArgs.tuning()
+		if err != nil {
+			return nil, err
+		}
+		tuning = tuning.merge(argsTuning)
+	}
+	return tuning.merge(c.RuntimeConfig.Tuning), nil
+}
+
+// RequestedIP returns the ip requested by CNI_ARGS IP or args.cni.ips of the network config, CNI_ARGS takes precedence.
+func (c *PluginConf) RequestedIP(k8sArgs *K8sArgs) (net.IP, error) {
+	if k8sArgs != nil && k8sArgs.IP != nil {
+		return k8sArgs.IP, nil
+	}
+	if c.Args == nil || c.Args.A == nil || len(c.Args.A.IPs) == 0 {
+		return nil, nil
+	}
+	// the ips may be in CIDR notation
+	ipStr, _, _ := strings.Cut(c.Args.A.IPs[0], "/")
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %q in args", c.Args.A.IPs[0])
+	}
+	return ip, nil
+}
+
+// BridgeOpts configures the bridge, settings that aren't set are left as they are.
+type BridgeOpts struct {
+	STP *bool `json:"stp,omitempty"`
+	// ForwardDelay is in seconds
+	ForwardDelay      *int  `json:"forwardDelay,omitempty"`
+	MulticastSnooping *bool `json:"multicastSnooping,omitempty"`
+	VlanFiltering     *bool `json:"vlanFiltering,omitempty"`
+}
+
+// PortConf configures the bridge port of every host veth.
+type PortConf struct {
+	// HairpinMode lets a pod reach itself through a Service VIP
+	HairpinMode bool `json:"hairpinMode,omitempty"`
+	// PromiscMode puts the bridge into promiscuous mode
+	PromiscMode bool `json:"promiscMode,omitempty"`
+	// PortIsolation prevents pods on the node from talking to each other at layer 2
+	PortIsolation bool `json:"portIsolation,omitempty"`
+	// MACLearning and UnicastFlood are left as the kernel default if not set
+	MACLearning  *bool `json:"macLearning,omitempty"`
+	UnicastFlood *bool `json:"unicastFlood,omitempty"`
+}
+
 type PluginConf struct {
 	types.NetConf
 
@@ -48,11 +282,52 @@ type PluginConf struct {
 		Config map[string]interface{} `json:"config"`
 	} `json:"runtimeConf,omitempty"`
 
+	// RuntimeConfig is filled by the runtime from the capabilities declared in the network config
+	RuntimeConfig struct {
+		PortMaps  []PortMapping `json:"portMappings,omitempty"`
+		Bandwidth *Bandwidth    `json:"bandwidth,omitempty"`
+		MAC       string        `json:"mac,omitempty"`
+		Tuning    *TuningConf   `json:"tuning,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
 	Args *struct {
-		A map[string]interface{} `json:"cni"`
+		A *ConfArgs `json:"cni"`
 	} `json:"args"`
 
 	DataDir string `json:"dataDir"`
+	// MTU overrides the mtu in the subnet file
+	MTU int `json:"mtu,omitempty"`
+
+	Log *LogConf `json:"log,omitempty"`
+
+	// HostVethPrefix is the prefix of host veth names, which are derived from the container ID and ifName
+	HostVethPrefix string `json:"hostVethPrefix,omitempty"`
+	// MACFromIP derives the mac of the container veth from the pod ip
+	MACFromIP bool `json:"macFromIP,omitempty"`
+
+	Tuning *TuningConf `json:"tuning,omitempty"`
+
+	// Mode is the datapath, ModeBridge if empty
+	Mode string `json:"mode,omitempty"`
+	// Master is the parent NIC of ModeMacvlan and ModeIPvlan
+	Master string `json:"master,omitempty"`
+	// IPvlanMode is IPvlanModeL2 or IPvlanModeL3, IPvlanModeL2 if empty
+	IPvlanMode string `json:"ipvlanMode,omitempty"`
+	// BridgeOpts, PortConf and VLANConf only apply to ModeBridge
+	BridgeOpts
+	PortConf
+	VLANConf
+}
+
+// VLANConf tags the host veth of every pod with a VLAN, pods in different VLANs can't talk to each other at layer 2.
+// The bridge is VLAN-aware whenever a VLAN is configured.
+type VLANConf struct {
+	// VLAN is the VLAN of pods whose namespace isn't in NamespaceVLANs, 0 leaves them untagged
+	VLAN int `json:"vlan,omitempty"`
+	// NamespaceVLANs maps the namespace of a pod, K8S_POD_NAMESPACE of CNI_ARGS, to its VLAN
+	NamespaceVLANs map[string]int `json:"namespaceVlans,omitempty"`
+	// VLANUplink carries the VLANs off the node, a sub-interface of it is attached to the bridge for every VLAN in use
+	VLANUplink string `json:"vlanUplink,omitempty"`
 }
 
 func parsePluginConf(stdin []byte) (*PluginConf, error) {
@@ -60,12 +335,141 @@ func parsePluginConf(stdin []byte) (*PluginConf, error) {
 	if err := json.Unmarshal(stdin, conf); err != nil {
 		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
 	}
+	if len(conf.HostVethPrefix) > MaxHostVethPrefixLen {
+		return nil, fmt.Errorf("hostVethPrefix %q is longer than %d characters", conf.HostVethPrefix, MaxHostVethPrefixLen)
+	}
+	if err := conf.validateMode(); err != nil {
+		return nil, err
+	}
+	switch conf.IPvlanMode {
+	case "":
+		conf.IPvlanMode = IPvlanModeL2
+	case IPvlanModeL2, IPvlanModeL3:
+	default:
+		return nil, fmt.Errorf("unknown ipvlanMode %q", conf.IPvlanMode)
+	}
+	if err := conf.VLANConf.validate(); err != nil {
+		return nil, err
+	}
+	if conf.VLAN != 0 || len(conf.NamespaceVLANs) > 0 {
+		if conf.VlanFiltering != nil && !*conf.VlanFiltering {
+			return nil, fmt.Errorf("vlan requires vlanFiltering")
+		}
+		vlanFiltering := true
+		conf.VlanFiltering = &vlanFiltering
+	}
+
+	// when running in a conflist, prevResult may be in any supported cniVersion,
+	// convert it to the current version so that callers only deal with one type
+	if conf.RawPrevResult != nil {
+		if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+			return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+		}
+		result, err := current.NewResultFromResult(conf.PrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert prevResult: %v", err)
+		}
+		conf.PrevResult = result
+	}
 	return conf, nil
 }
 
+// inheritMode sets the mode of the daemonset, which creates the bridge and routes only in the modes that need them,
+// if the network config leaves it out. A network config that sets a different one is an error.
+func (c *PluginConf) inheritMode(mode string) error {
+	if mode == "" || c.Mode == mode {
+		return nil
+	}
+	if c.Mode != "" {
+		return fmt.Errorf("mode %s of the network config doesn't match mode %s of the daemonset", c.Mode, mode)
+	}
+	c.Mode = mode
+	return c.validateMode()
+}
+
+// validateMode checks the settings that depend on the mode, which may come from the subnet file.
+func (c *PluginConf) validateMode() error {
+	switch c.Mode {
+	case "", ModeBridge, ModeRouted:
+	case ModeMacvlan, ModeIPvlan:
+		if c.Master == "" {
+			return fmt.Errorf("mode %s requires master", c.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	if c.Mode != "" && c.Mode != ModeBridge && (c.VLAN != 0 || len(c.NamespaceVLANs) > 0) {
+		return fmt.Errorf("vlan requires mode %s", ModeBridge)
+	}
+	return nil
+}
+
+func (c *VLANConf) validate() error {
+	if c.VLAN < 0 || c.VLAN > MaxVLAN {
+		return fmt.Errorf("invalid vlan %d", c.VLAN)
+	}
+	for namespace, vlan := range c.NamespaceVLANs {
+		if vlan < 0 || vlan > MaxVLAN {
+			return fmt.Errorf("invalid vlan %d of namespace %s", vlan, namespace)
+		}
+	}
+	return nil
+}
+
+// PodVLAN returns the VLAN of the pod, or 0 if it is untagged.
+func (c *VLANConf) PodVLAN(k8sArgs *K8sArgs) int {
+	if k8sArgs != nil {
+		if vlan, ok := c.NamespaceVLANs[string(k8sArgs.K8S_POD_NAMESPACE)]; ok {
+			return vlan
+		}
+	}
+	return c.VLAN
+}
+
+// Routed reports whether pods are routed point-to-point instead of attached to the bridge.
+func (c *PluginConf) Routed() bool {
+	return c.Mode == ModeRouted
+}
+
+// Direct reports whether pods are attached to the Master NIC with a macvlan or ipvlan sub-interface.
+func (c *PluginConf) Direct() bool {
+	return c.Mode == ModeMacvlan || c.Mode == ModeIPvlan
+}
+
+// LoadLogConf returns the log config of stdin, it is parsed on its own so that
+// a network config that fails to parse can still be logged. It returns nil if there is none.
+func LoadLogConf(stdin []byte) *LogConf {
+	conf := &struct {
+		Log *LogConf `json:"log"`
+	}{}
+	_ = json.Unmarshal(stdin, conf)
+	return conf.Log
+}
+
+// CurrentPrevResult returns the prevResult converted to the current cniVersion, or nil if there is none.
+func (c *PluginConf) CurrentPrevResult() *current.Result {
+	if c.PrevResult == nil {
+		return nil
+	}
+	result, _ := c.PrevResult.(*current.Result)
+	return result
+}
+
+// CNIConf merges the network config and the subnet file, it is only built in memory and never serialized.
 type CNIConf struct {
-	PluginConf
-	SubnetConf
+	PluginConf `json:"-"`
+	SubnetConf `json:"-"`
+}
+
+// LinkMTU returns the mtu of the bridge and veth pairs, the network config takes precedence over the subnet file.
+func (c *CNIConf) LinkMTU() int {
+	if c.PluginConf.MTU > 0 {
+		return c.PluginConf.MTU
+	}
+	if c.SubnetConf.MTU > 0 {
+		return c.SubnetConf.MTU
+	}
+	return DefaultMTU
 }
 
 func LoadCNIConfig(stdin []byte) (*CNIConf, error) {
@@ -78,6 +482,9 @@ func LoadCNIConfig(stdin []byte) (*CNIConf, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = pluginConf.inheritMode(subnetConf.DatapathMode); err != nil {
+		return nil, err
+	}
 
 	return &CNIConf{
 		PluginConf: *pluginConf,
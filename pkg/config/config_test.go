@@ -0,0 +1,207 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrevResult(t *testing.T) {
+	tests := []struct {
+		name  string
+		stdin string
+	}{
+		{
+			name: "0.3.1",
+			stdin: `{
+				"cniVersion": "0.3.1",
+				"name": "simple-cni-plugin",
+				"type": "simple-cni-plugin",
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [{"name": "eth0", "sandbox": "/var/run/netns/test"}],
+					"ips": [{"version": "4", "address": "10.244.1.2/24", "gateway": "10.244.1.1", "interface": 0}]
+				}
+			}`,
+		},
+		{
+			name: "1.0.0",
+			stdin: `{
+				"cniVersion": "1.0.0",
+				"name": "simple-cni-plugin",
+				"type": "simple-cni-plugin",
+				"prevResult": {
+					"cniVersion": "1.0.0",
+					"interfaces": [{"name": "eth0", "sandbox": "/var/run/netns/test"}],
+					"ips": [{"address": "10.244.1.2/24", "gateway": "10.244.1.1", "interface": 0}]
+				}
+			}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := parsePluginConf([]byte(tt.stdin))
+			require.NoError(t, err)
+
+			result := conf.CurrentPrevResult()
+			require.NotNil(t, result)
+			require.Len(t, result.Interfaces, 1)
+			require.Equal(t, "eth0", result.Interfaces[0].Name)
+			require.Len(t, result.IPs, 1)
+			require.Equal(t, "10.244.1.2/24", result.IPs[0].Address.String())
+			require.Equal(t, 0, *result.IPs[0].Interface)
+		})
+	}
+}
+
+func TestParseWithoutPrevResult(t *testing.T) {
+	conf, err := parsePluginConf([]byte(`{"cniVersion": "0.4.0", "name": "simple-cni-plugin", "type": "simple-cni-plugin"}`))
+	require.NoError(t, err)
+	require.Nil(t, conf.CurrentPrevResult())
+}
+
+func TestLoadK8sArgs(t *testing.T) {
+	k8sArgs, err := LoadK8sArgs("IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=nginx;K8S_POD_INFRA_CONTAINER_ID=abc;K8S_POD_UID=uid;IP=10.244.1.5;FOO=bar")
+	require.NoError(t, err)
+	require.Equal(t, "default/nginx", k8sArgs.PodName())
+	require.Equal(t, "10.244.1.5", k8sArgs.IP.String())
+	require.Equal(t, "uid", string(k8sArgs.K8S_POD_UID))
+
+	// unknown args are an error without IgnoreUnknown
+	_, err = LoadK8sArgs("K8S_POD_NAME=nginx;FOO=bar")
+	require.Error(t, err)
+
+	k8sArgs, err = LoadK8sArgs("")
+	require.NoError(t, err)
+	require.Equal(t, "", k8sArgs.PodName())
+}
+
+func TestLoadK8sArgsLenient(t *testing.T) {
+	k8sArgs := LoadK8sArgsLenient("K8S_POD_NAMESPACE=default;K8S_POD_NAME=nginx;IP=10.244.1;FOO=bar;MAC")
+	require.Equal(t, "default/nginx", k8sArgs.PodName())
+	require.Nil(t, k8sArgs.IP)
+
+	k8sArgs = LoadK8sArgsLenient("")
+	require.Equal(t, "", k8sArgs.PodName())
+}
+
+func TestRequestedIP(t *testing.T) {
+	conf, err := parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "args": {"cni": {"ips": ["10.244.1.6/24"]}}}`))
+	require.NoError(t, err)
+
+	ip, err := conf.RequestedIP(&K8sArgs{})
+	require.NoError(t, err)
+	require.Equal(t, "10.244.1.6", ip.String())
+
+	// CNI_ARGS takes precedence over the network config
+	k8sArgs, err := LoadK8sArgs("IP=10.244.1.5")
+	require.NoError(t, err)
+	ip, err = conf.RequestedIP(k8sArgs)
+	require.NoError(t, err)
+	require.Equal(t, "10.244.1.5", ip.String())
+}
+
+func TestRequestedMAC(t *testing.T) {
+	conf, err := parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "args": {"cni": {"mac": "0a:58:00:00:00:01"}}}`))
+	require.NoError(t, err)
+
+	mac, err := conf.RequestedMAC(&K8sArgs{})
+	require.NoError(t, err)
+	require.Equal(t, "0a:58:00:00:00:01", mac)
+
+	k8sArgs, err := LoadK8sArgs("MAC=0A:58:00:00:00:02")
+	require.NoError(t, err)
+	mac, err = conf.RequestedMAC(k8sArgs)
+	require.NoError(t, err)
+	require.Equal(t, "0a:58:00:00:00:02", mac)
+
+	// the mac capability takes precedence over everything else
+	conf.RuntimeConfig.MAC = "0a:58:00:00:00:03"
+	mac, err = conf.RequestedMAC(k8sArgs)
+	require.NoError(t, err)
+	require.Equal(t, "0a:58:00:00:00:03", mac)
+
+	conf.RuntimeConfig.MAC = "invalid"
+	_, err = conf.RequestedMAC(k8sArgs)
+	require.Error(t, err)
+}
+
+func TestPodVLAN(t *testing.T) {
+	conf, err := parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "vlan": 100, "namespaceVlans": {"tenant-a": 200}}`))
+	require.NoError(t, err)
+	require.True(t, *conf.VlanFiltering)
+
+	require.Equal(t, 100, conf.PodVLAN(&K8sArgs{}))
+	k8sArgs, err := LoadK8sArgs("K8S_POD_NAMESPACE=tenant-a")
+	require.NoError(t, err)
+	require.Equal(t, 200, conf.PodVLAN(k8sArgs))
+
+	_, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "vlan": 100, "vlanFiltering": false}`))
+	require.Error(t, err)
+	_, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "namespaceVlans": {"tenant-a": 4095}}`))
+	require.Error(t, err)
+}
+
+func TestInheritMode(t *testing.T) {
+	conf, err := parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin"}`))
+	require.NoError(t, err)
+	require.NoError(t, conf.inheritMode(""))
+	require.Equal(t, "", conf.Mode)
+	require.NoError(t, conf.inheritMode(ModeRouted))
+	require.True(t, conf.Routed())
+
+	// the network config must agree with the daemonset
+	require.Error(t, conf.inheritMode(ModeBridge))
+
+	// the settings of the inherited mode are checked too
+	conf, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin"}`))
+	require.NoError(t, err)
+	require.Error(t, conf.inheritMode(ModeMacvlan))
+	conf, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "vlan": 100}`))
+	require.NoError(t, err)
+	require.Error(t, conf.inheritMode(ModeRouted))
+}
+
+func TestRequestedTuning(t *testing.T) {
+	conf, err := parsePluginConf([]byte(`{
+		"name": "simple-cni-plugin",
+		"type": "simple-cni-plugin",
+		"tuning": {"sysctl": {"net.ipv4.conf.eth0.rp_filter": "1", "net.ipv4.conf.eth0.arp_notify": "1"}, "txQueueLen": 500},
+		"runtimeConfig": {"tuning": {"txChecksumOffload": false}}
+	}`))
+	require.NoError(t, err)
+
+	k8sArgs, err := LoadK8sArgs("SYSCTL=net.ipv4.conf.eth0.rp_filter:0;TXQUEUELEN=1000")
+	require.NoError(t, err)
+	tuning, err := conf.RequestedTuning(k8sArgs)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"net.ipv4.conf.eth0.rp_filter": "0", "net.ipv4.conf.eth0.arp_notify": "1"}, tuning.Sysctl)
+	require.Equal(t, 1000, *tuning.TxQueueLen)
+	require.False(t, *tuning.TxChecksumOffload)
+
+	k8sArgs, err = LoadK8sArgs("SYSCTL=net.ipv4.conf.eth0.rp_filter")
+	require.NoError(t, err)
+	_, err = conf.RequestedTuning(k8sArgs)
+	require.Error(t, err)
+}
+
+func TestParseMode(t *testing.T) {
+	conf, err := parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "mode": "routed"}`))
+	require.NoError(t, err)
+	require.True(t, conf.Routed())
+
+	_, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "mode": "overlay"}`))
+	require.Error(t, err)
+	_, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "mode": "routed", "vlan": 100}`))
+	require.Error(t, err)
+
+	conf, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "mode": "ipvlan", "master": "eth1"}`))
+	require.NoError(t, err)
+	require.True(t, conf.Direct())
+	require.Equal(t, IPvlanModeL2, conf.IPvlanMode)
+	_, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "mode": "macvlan"}`))
+	require.Error(t, err)
+	_, err = parsePluginConf([]byte(`{"name": "simple-cni-plugin", "type": "simple-cni-plugin", "mode": "ipvlan", "master": "eth1", "ipvlanMode": "l3s"}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,325 @@
+// Package direct attaches pods to a parent NIC with a macvlan or ipvlan sub-interface instead of a veth pair,
+// which saves the hop through the host veth and the bridge.
+// The host can't talk to its own sub-interfaces through the parent, so a shim sub-interface in the host
+// holds the gateway of the node subnet.
+package direct
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/bridge"
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+	"github.com/mayooot/simple-cni-plugin/pkg/tuning"
+)
+
+const (
+	// ShimName is the host-side sub-interface that holds the gateway
+	ShimName = "scni-shim"
+	// the sub-interface is created under a temporary name and renamed to ifName in the netns
+	tmpPrefix = "scnt"
+)
+
+var (
+	ShimMismatchError      = errors.New("shim doesn't match")
+	InterfaceNotFoundError = errors.New("container interface not found")
+	InterfaceMismatchError = errors.New("container interface doesn't match")
+)
+
+// Conf describes the sub-interface of a container.
+type Conf struct {
+	// Mode is config.ModeMacvlan or config.ModeIPvlan
+	Mode       string
+	IPvlanMode string
+	Master     string
+
+	ContainerID string
+	IfName      string
+	// MAC of the container interface, only for macvlan, it is random if empty
+	MAC    string
+	MTU    int
+	PodIP  *net.IPNet
+	Tuning *config.TuningConf
+	// Gateway is the default gateway of the pod, ipvlan l3 routes through the interface without one
+	Gateway net.IP
+}
+
+// L3 reports whether the pods are in ipvlan l3 mode, which has no broadcast domain and no gateway.
+func (c *Conf) L3() bool {
+	return c.Mode == config.ModeIPvlan && c.IPvlanMode == config.IPvlanModeL3
+}
+
+func (c *Conf) newLink(name string, parentIndex int) netlink.Link {
+	attrs := netlink.LinkAttrs{
+		Name:        name,
+		ParentIndex: parentIndex,
+		MTU:         c.MTU,
+	}
+	if c.Mode == config.ModeMacvlan {
+		return &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	}
+	return &netlink.IPVlan{LinkAttrs: attrs, Mode: c.ipvlanMode()}
+}
+
+func (c *Conf) ipvlanMode() netlink.IPVlanMode {
+	if c.IPvlanMode == config.IPvlanModeL3 {
+		return netlink.IPVLAN_MODE_L3
+	}
+	return netlink.IPVLAN_MODE_L2
+}
+
+// matches reports whether link is a sub-interface of the kind and mode in c on the master with masterIndex.
+func (c *Conf) matches(link netlink.Link, masterIndex int) bool {
+	if link.Attrs().ParentIndex != masterIndex {
+		return false
+	}
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		return c.Mode == config.ModeMacvlan && l.Mode == netlink.MACVLAN_MODE_BRIDGE
+	case *netlink.IPVlan:
+		return c.Mode == config.ModeIPvlan && l.Mode == c.ipvlanMode()
+	}
+	return false
+}
+
+// EnsureShim creates the shim on the master if it doesn't exist and makes sure it is up and holds gateway.
+// In ipvlan l3 mode the shim holds the gateway as a /32 and the node subnet is routed through it.
+func EnsureShim(conf *Conf, gateway *net.IPNet) (netlink.Link, error) {
+	master, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find master %s: %v", conf.Master, err)
+	}
+	shim, err := netlink.LinkByName(ShimName)
+	if err != nil {
+		if !bridge.IsLinkNotFound(err) {
+			return nil, err
+		}
+		// another ADD may create it concurrently
+		if err = netlink.LinkAdd(conf.newLink(ShimName, master.Attrs().Index)); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return nil, fmt.Errorf("failed to create %s: %v", ShimName, err)
+		}
+		if shim, err = netlink.LinkByName(ShimName); err != nil {
+			return nil, err
+		}
+	}
+	if !conf.matches(shim, master.Attrs().Index) {
+		return nil, fmt.Errorf("%w: %s is a %s, expected a %s on %s", ShimMismatchError, ShimName, shim.Type(), conf.Mode, conf.Master)
+	}
+
+	addr := gateway
+	if conf.L3() {
+		addr = &net.IPNet{IP: gateway.IP, Mask: net.CIDRMask(32, 32)}
+	}
+	if err = netlink.AddrAdd(shim, &netlink.Addr{IPNet: addr}); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return nil, fmt.Errorf("failed to add gateway %s to %s: %v", addr, ShimName, err)
+	}
+	if err = netlink.LinkSetUp(shim); err != nil {
+		return nil, err
+	}
+	if conf.L3() {
+		err = netlink.RouteReplace(&netlink.Route{
+			LinkIndex: shim.Attrs().Index,
+			Dst:       &net.IPNet{IP: gateway.IP.Mask(gateway.Mask), Mask: gateway.Mask},
+			Scope:     netlink.SCOPE_LINK,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to route %s through %s: %v", gateway, ShimName, err)
+		}
+	}
+	return shim, nil
+}
+
+// CheckShim verifies that the shim exists, is up and holds gateway.
+func CheckShim(conf *Conf, gateway net.IP) error {
+	master, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return fmt.Errorf("failed to find master %s: %v", conf.Master, err)
+	}
+	shim, err := netlink.LinkByName(ShimName)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ShimMismatchError, err)
+	}
+	if !conf.matches(shim, master.Attrs().Index) {
+		return fmt.Errorf("%w: %s is a %s, expected a %s on %s", ShimMismatchError, ShimName, shim.Type(), conf.Mode, conf.Master)
+	}
+	if shim.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%w: %s is down", ShimMismatchError, ShimName)
+	}
+	addrs, err := netlink.AddrList(shim, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(gateway) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s doesn't hold gateway %s", ShimMismatchError, ShimName, gateway)
+}
+
+// tmpLinkName returns the temporary name of the sub-interface of a container, unique per attachment.
+func tmpLinkName(containerID, ifName string) string {
+	sum := sha256.Sum256([]byte(containerID + "/" + ifName))
+	// linux interface names are at most 15 characters
+	return (tmpPrefix + hex.EncodeToString(sum[:]))[:15]
+}
+
+// Setup creates the sub-interface of a container on the master and configures it in netNS.
+// It returns the container interface so that it can be reported in the CNI result.
+// If any step fails after the sub-interface is created, it is deleted again.
+func Setup(netNS ns.NetNS, conf *Conf) (_ *current.Interface, err error) {
+	if err = tuning.Validate(conf.IfName, conf.Tuning); err != nil {
+		return nil, err
+	}
+	master, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find master %s: %v", conf.Master, err)
+	}
+	// the sub-interface is created right in netNS, a leftover of an earlier attempt of the same container is there too
+	tmpName := tmpLinkName(conf.ContainerID, conf.IfName)
+	err = netNS.Do(func(ns.NetNS) error {
+		l, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			if bridge.IsLinkNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		if err = netlink.LinkDel(l); err != nil && !bridge.IsLinkNotFound(err) {
+			return fmt.Errorf("failed to delete stale %q: %v", tmpName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	link := conf.newLink(tmpName, master.Attrs().Index)
+	if conf.Mode == config.ModeMacvlan && conf.MAC != "" {
+		if link.Attrs().HardwareAddr, err = net.ParseMAC(conf.MAC); err != nil {
+			return nil, err
+		}
+	}
+	link.Attrs().Namespace = netlink.NsFd(int(netNS.Fd()))
+	if err = netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s on %s: %v", conf.Mode, conf.Master, err)
+	}
+
+	containerIface := &current.Interface{}
+	err = netNS.Do(func(ns.NetNS) (err error) {
+		device, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			return err
+		}
+		index := device.Attrs().Index
+		defer func() {
+			if l, _ := netlink.LinkByIndex(index); err != nil && l != nil {
+				_ = netlink.LinkDel(l)
+			}
+		}()
+		if err = netlink.LinkSetName(device, conf.IfName); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %v", tmpName, conf.IfName, err)
+		}
+		if device, err = netlink.LinkByIndex(index); err != nil {
+			return err
+		}
+		if err = netlink.AddrAdd(device, &netlink.Addr{IPNet: conf.PodIP}); err != nil {
+			return err
+		}
+		if err = tuning.Apply(device, conf.Tuning); err != nil {
+			return err
+		}
+		if err = netlink.LinkSetUp(device); err != nil {
+			return err
+		}
+		if conf.L3() {
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: device.Attrs().Index,
+				Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				Scope:     netlink.SCOPE_LINK,
+			})
+		} else {
+			err = ip.AddDefaultRoute(conf.Gateway, device)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add default route: %v", err)
+		}
+
+		containerIface.Name = device.Attrs().Name
+		containerIface.Mac = device.Attrs().HardwareAddr.String()
+		containerIface.Mtu = device.Attrs().MTU
+		containerIface.Sandbox = netNS.Path()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return containerIface, nil
+}
+
+// Del removes the sub-interface of a container, a missing interface is not an error.
+// netNS may be nil when the netns is already gone, which takes the sub-interface with it.
+func Del(netNS ns.NetNS, ifName string) error {
+	if netNS == nil {
+		return nil
+	}
+	return netNS.Do(func(ns.NetNS) error {
+		device, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if bridge.IsLinkNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		if err = netlink.LinkDel(device); err != nil && !bridge.IsLinkNotFound(err) {
+			return fmt.Errorf("failed to delete %q: %v", ifName, err)
+		}
+		return nil
+	})
+}
+
+// Check validates the sub-interface of a container against conf and what prevResult reported for it.
+func Check(netNS ns.NetNS, conf *Conf, contIface *current.Interface, ips []*current.IPConfig, routes []*types.Route) error {
+	master, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return fmt.Errorf("failed to find master %s: %v", conf.Master, err)
+	}
+	return netNS.Do(func(ns.NetNS) error {
+		device, err := netlink.LinkByName(conf.IfName)
+		if err != nil {
+			if bridge.IsLinkNotFound(err) {
+				return fmt.Errorf("%w: %s", InterfaceNotFoundError, conf.IfName)
+			}
+			return err
+		}
+		if !conf.matches(device, master.Attrs().Index) {
+			return fmt.Errorf("%w: %s is a %s, expected a %s on %s", InterfaceMismatchError, conf.IfName, device.Type(), conf.Mode, conf.Master)
+		}
+		if device.Attrs().MTU != conf.MTU {
+			return fmt.Errorf("%w: %s has mtu %d, expected %d", InterfaceMismatchError, conf.IfName, device.Attrs().MTU, conf.MTU)
+		}
+		if contIface.Mac != "" && contIface.Mac != device.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("%w: %s has mac %s, expected %s", InterfaceMismatchError, conf.IfName, device.Attrs().HardwareAddr, contIface.Mac)
+		}
+		if device.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%w: %s is down", InterfaceMismatchError, conf.IfName)
+		}
+		if err = ip.ValidateExpectedInterfaceIPs(conf.IfName, ips); err != nil {
+			return fmt.Errorf("%w: %v", InterfaceMismatchError, err)
+		}
+		if err = ip.ValidateExpectedRoute(routes); err != nil {
+			return fmt.Errorf("%w: %v", InterfaceMismatchError, err)
+		}
+		return tuning.Check(device, conf.Tuning)
+	})
+}
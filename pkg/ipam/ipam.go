@@ -8,6 +8,7 @@ import (
 	cip "github.com/containernetworking/plugins/pkg/ip"
 
 	"github.com/mayooot/simple-cni-plugin/pkg/config"
+	"github.com/mayooot/simple-cni-plugin/pkg/logging"
 	"github.com/mayooot/simple-cni-plugin/pkg/store"
 )
 
@@ -64,7 +65,8 @@ func (im *IPAM) NextIP(ip net.IP) (net.IP, error) {
 	return nextIP, nil
 }
 
-func (im *IPAM) AllocateIP(id, ifName string) (net.IP, error) {
+// AllocateIP allocates an ip for the container id, requested is the ip the container asks for and may be nil.
+func (im *IPAM) AllocateIP(id, ifName string, requested net.IP) (net.IP, error) {
 	im.store.Lock()
 	defer im.store.Unlock()
 
@@ -73,8 +75,14 @@ func (im *IPAM) AllocateIP(id, ifName string) (net.IP, error) {
 	}
 	ip, _ := im.store.GetIPByID(id)
 	if len(ip) > 0 {
+		if requested != nil && !requested.Equal(ip) {
+			return nil, fmt.Errorf("container %s already has ip %s, can't allocate the requested ip %s", id, ip, requested)
+		}
 		return ip, nil
 	}
+	if requested != nil {
+		return im.allocateRequestedIP(id, ifName, requested)
+	}
 
 	// when initialized for the first time, last is empty, but the gateway is already set.
 	// e.g. subnet is 10.244.1.0/24, gateway is 10.244.1.1
@@ -100,6 +108,7 @@ func (im *IPAM) AllocateIP(id, ifName string) (net.IP, error) {
 		}
 
 		if !im.store.Contain(nextIP) {
+			logging.Log.Info("allocate ip", "ip", nextIP.String())
 			err := im.store.Add(nextIP, id, ifName)
 			return nextIP, err
 		}
@@ -113,12 +122,30 @@ func (im *IPAM) AllocateIP(id, ifName string) (net.IP, error) {
 			break
 		}
 
-		fmt.Printf("ip: %s\n", nextIP)
+		logging.Log.V(1).Info("ip is in use", "ip", nextIP.String())
 	}
 
 	return nil, fmt.Errorf("no avaiable ip")
 }
 
+func (im *IPAM) allocateRequestedIP(id, ifName string, ip net.IP) (net.IP, error) {
+	ip = ip.To4()
+	if ip == nil || !im.subnet.Contains(ip) {
+		return nil, fmt.Errorf("requested ip %s is not in subnet %s", ip, im.subnet)
+	}
+	if ip.Equal(im.subnet.IP) || ip.Equal(im.gateway) {
+		return nil, fmt.Errorf("requested ip %s is reserved", ip)
+	}
+	if _, err := im.NextIP(ip); err != nil {
+		return nil, fmt.Errorf("requested ip %s is the broadcast address", ip)
+	}
+	if im.store.Contain(ip) {
+		return nil, fmt.Errorf("requested ip %s is already in use", ip)
+	}
+	logging.Log.Info("allocate requested ip", "ip", ip.String())
+	return ip, im.store.Add(ip, id, ifName)
+}
+
 func (im *IPAM) ReleaseIP(id string) error {
 	im.store.Lock()
 	defer im.store.Unlock()
@@ -5,6 +5,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+	"github.com/mayooot/simple-cni-plugin/pkg/store"
 )
 
 func TestNextIP(t *testing.T) {
@@ -21,3 +24,41 @@ func TestNextIP(t *testing.T) {
 	require.Nil(t, ip)
 	require.Equal(t, err, IPOverflowError)
 }
+
+func TestAllocateRequestedIP(t *testing.T) {
+	s, err := store.NewStore(t.TempDir(), "test")
+	require.NoError(t, err)
+	defer s.Close()
+	im, err := NewIPAM(&config.CNIConf{SubnetConf: config.SubnetConf{Subnet: "10.244.1.0/24"}}, s)
+	require.NoError(t, err)
+
+	ip, err := im.AllocateIP("a", "eth0", net.ParseIP("10.244.1.10"))
+	require.NoError(t, err)
+	require.Equal(t, "10.244.1.10", ip.String())
+
+	// a repeated ADD gets the same ip, but can't ask for another one
+	ip, err = im.AllocateIP("a", "eth0", net.ParseIP("10.244.1.10"))
+	require.NoError(t, err)
+	require.Equal(t, "10.244.1.10", ip.String())
+	_, err = im.AllocateIP("a", "eth0", net.ParseIP("10.244.1.11"))
+	require.Error(t, err)
+
+	for _, requested := range []string{
+		// in use
+		"10.244.1.10",
+		// the network address, the gateway and the broadcast address are reserved
+		"10.244.1.0",
+		"10.244.1.1",
+		"10.244.1.255",
+		// out of the subnet
+		"10.244.2.10",
+	} {
+		_, err = im.AllocateIP("b", "eth0", net.ParseIP(requested))
+		require.Error(t, err, requested)
+	}
+
+	// without a requested ip the allocation goes on after the last allocated ip
+	ip, err = im.AllocateIP("b", "eth0", nil)
+	require.NoError(t, err)
+	require.Equal(t, "10.244.1.11", ip.String())
+}
@@ -0,0 +1,60 @@
+// Package logging writes the diagnostics of the plugin to a log file.
+// The plugin must never write anything but the CNI result to stdout, so nothing is logged there.
+// Every ADD, CHECK and DEL runs in its own process and many may run at once, so the file is only appended to and
+// never rotated by the plugin, which would race with the other processes. Rotate it with logrotate's copytruncate.
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+const DefaultLogFile = "/var/log/simple-cni-plugin/simple-cni-plugin.log"
+
+// Log is the logger of the plugin, it discards everything until Init is called.
+var Log = logr.Discard()
+
+// Init sets up Log to append to the log file in conf, keysAndValues are added to every line.
+// Debug lines are logged with Log.V(1). Log keeps discarding everything if the file can't be opened,
+// the plugin doesn't fail for its diagnostics.
+func Init(conf *config.LogConf, keysAndValues ...interface{}) {
+	if conf == nil {
+		conf = &config.LogConf{}
+	}
+	name := conf.File
+	if name == "" {
+		name = DefaultLogFile
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return
+	}
+	// each line is a single write, which O_APPEND keeps whole among the concurrent processes
+	writer, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	encoderConf := zap.NewProductionEncoderConfig()
+	encoderConf.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConf), zapcore.AddSync(writer), parseLevel(conf.Level))
+	Log = zapr.NewLogger(zap.New(core)).WithValues(keysAndValues...)
+}
+
+func parseLevel(level string) zapcore.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return zapcore.DebugLevel
+	case "error":
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
@@ -0,0 +1,282 @@
+// Package portmap implements hostPort for pods with iptables nat rules.
+//
+// Every container with port mappings gets its own DNAT and SNAT chain,
+// which are jumped to from the shared SCNI-HOSTPORTS and SCNI-HOSTPORTS-SN chains:
+//
+//	PREROUTING/OUTPUT (dst-type LOCAL) -> SCNI-HOSTPORTS -> SCNI-DN-<hash>: DNAT hostPort to podIP:containerPort
+//	POSTROUTING -> SCNI-HOSTPORTS-SN -> SCNI-SN-<hash>: MASQUERADE hairpin and localhost traffic
+//
+// The jump rules and the rules of the container chains carry the network name and container ID in a comment,
+// so that rules of removed containers can be garbage-collected per network, even when their jump rules are gone.
+package portmap
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+const (
+	natTable        = "nat"
+	hostPortsChain  = "SCNI-HOSTPORTS"
+	hostSNATChain   = "SCNI-HOSTPORTS-SN"
+	dnatChainPrefix = "SCNI-DN-"
+	snatChainPrefix = "SCNI-SN-"
+	commentPrefix   = "simple-cni-plugin: "
+)
+
+var commentRegexp = regexp.MustCompile(`--comment "?` + commentPrefix + `([^" /]+)/([^" ]+)"?`)
+
+// Forward installs the port mappings of a container, bridge is where pod traffic enters the host.
+func Forward(netName, containerID string, podIP net.IP, bridge string, mappings []config.PortMapping) error {
+	if len(mappings) == 0 {
+		return nil
+	}
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+	if err = setupHostPortsChains(ipt); err != nil {
+		return err
+	}
+
+	dnatRules, snatRules, err := containerRules(netName, containerID, podIP, mappings)
+	if err != nil {
+		return err
+	}
+	dnatChain, snatChain := containerChains(netName, containerID)
+	if err = setupChain(ipt, dnatChain, dnatRules); err != nil {
+		return err
+	}
+	if err = setupChain(ipt, snatChain, snatRules); err != nil {
+		return err
+	}
+	if err = ipt.AppendUnique(natTable, hostPortsChain, jumpRule(netName, containerID, dnatChain)...); err != nil {
+		return err
+	}
+	if err = ipt.AppendUnique(natTable, hostSNATChain, jumpRule(netName, containerID, snatChain)...); err != nil {
+		return err
+	}
+
+	// localhost:hostPort is only routed to the pod when route_localnet is set on the bridge
+	_, err = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/route_localnet", bridge), "1")
+	return err
+}
+
+// Unforward removes the port mappings of a container, missing rules are not an error.
+func Unforward(netName, containerID string) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+	return unforward(ipt, netName, containerID)
+}
+
+func unforward(ipt *iptables.IPTables, netName, containerID string) error {
+	dnatChain, snatChain := containerChains(netName, containerID)
+	for _, c := range []struct{ parent, chain string }{{hostPortsChain, dnatChain}, {hostSNATChain, snatChain}} {
+		if exists, err := ipt.ChainExists(natTable, c.parent); err != nil {
+			return err
+		} else if exists {
+			if err = ipt.DeleteIfExists(natTable, c.parent, jumpRule(netName, containerID, c.chain)...); err != nil {
+				return err
+			}
+		}
+		if exists, err := ipt.ChainExists(natTable, c.chain); err != nil {
+			return err
+		} else if exists {
+			if err = ipt.ClearAndDeleteChain(natTable, c.chain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check verifies that all port mappings of a container are installed.
+func Check(netName, containerID string, podIP net.IP, mappings []config.PortMapping) error {
+	if len(mappings) == 0 {
+		return nil
+	}
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	dnatRules, snatRules, err := containerRules(netName, containerID, podIP, mappings)
+	if err != nil {
+		return err
+	}
+	dnatChain, snatChain := containerChains(netName, containerID)
+	expected := []struct {
+		chain string
+		rules [][]string
+	}{
+		{hostPortsChain, [][]string{jumpRule(netName, containerID, dnatChain)}},
+		{hostSNATChain, [][]string{jumpRule(netName, containerID, snatChain)}},
+		{dnatChain, dnatRules},
+		{snatChain, snatRules},
+	}
+	for _, e := range expected {
+		exists, err := ipt.ChainExists(natTable, e.chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("chain %s of container %s not found", e.chain, containerID)
+		}
+		for _, rule := range e.rules {
+			exists, err = ipt.Exists(natTable, e.chain, rule...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("rule %q not found in chain %s", strings.Join(rule, " "), e.chain)
+			}
+		}
+	}
+	return nil
+}
+
+// GC removes the port mappings of every container of network netName that is not in valid. The containers are found
+// by the comments of the jump rules and of the rules in the container chains, whose jump rules may be gone.
+func GC(netName string, valid map[string]bool) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+	chains, err := ipt.ListChains(natTable)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	for _, chain := range chains {
+		if chain != hostPortsChain && chain != hostSNATChain &&
+			!strings.HasPrefix(chain, dnatChainPrefix) && !strings.HasPrefix(chain, snatChainPrefix) {
+			continue
+		}
+		rules, err := ipt.List(natTable, chain)
+		if err != nil {
+			return err
+		}
+		for _, id := range containerIDs(rules, netName) {
+			ids[id] = true
+		}
+	}
+	for id := range ids {
+		if valid[id] {
+			continue
+		}
+		if err = unforward(ipt, netName, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupHostPortsChains(ipt *iptables.IPTables) error {
+	for _, chain := range []string{hostPortsChain, hostSNATChain} {
+		exists, err := ipt.ChainExists(natTable, chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err = ipt.NewChain(natTable, chain); err != nil {
+				return err
+			}
+		}
+	}
+
+	local := []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", hostPortsChain}
+	if err := ipt.InsertUnique(natTable, "PREROUTING", 1, local...); err != nil {
+		return err
+	}
+	if err := ipt.InsertUnique(natTable, "OUTPUT", 1, local...); err != nil {
+		return err
+	}
+	return ipt.InsertUnique(natTable, "POSTROUTING", 1, "-j", hostSNATChain)
+}
+
+// setupChain creates chain with exactly rules, replacing what it had before.
+func setupChain(ipt *iptables.IPTables, chain string, rules [][]string) error {
+	if err := ipt.ClearChain(natTable, chain); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := ipt.Append(natTable, chain, rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containerChains(netName, containerID string) (string, string) {
+	sum := sha256.Sum256([]byte(netName + "/" + containerID))
+	hash := strings.ToUpper(fmt.Sprintf("%x", sum[:8]))
+	return dnatChainPrefix + hash, snatChainPrefix + hash
+}
+
+func jumpRule(netName, containerID, chain string) []string {
+	return []string{"-m", "comment", "--comment", commentPrefix + netName + "/" + containerID, "-j", chain}
+}
+
+// containerRules generates the DNAT rules of hostPorts and the SNAT rules for hairpin and localhost traffic.
+func containerRules(netName, containerID string, podIP net.IP, mappings []config.PortMapping) ([][]string, [][]string, error) {
+	comment := []string{"-m", "comment", "--comment", commentPrefix + netName + "/" + containerID}
+	var dnatRules, snatRules [][]string
+	for _, m := range mappings {
+		if m.HostPort <= 0 || m.HostPort > 65535 || m.ContainerPort <= 0 || m.ContainerPort > 65535 {
+			return nil, nil, fmt.Errorf("invalid port mapping %d:%d", m.HostPort, m.ContainerPort)
+		}
+		proto := strings.ToLower(m.Protocol)
+		if proto == "" {
+			proto = "tcp"
+		}
+		if proto != "tcp" && proto != "udp" && proto != "sctp" {
+			return nil, nil, fmt.Errorf("unsupported protocol %q", m.Protocol)
+		}
+		hostPort := strconv.Itoa(m.HostPort)
+		containerPort := strconv.Itoa(m.ContainerPort)
+
+		dnat := append([]string{"-p", proto}, comment...)
+		if m.HostIP != "" {
+			hostIP := net.ParseIP(m.HostIP)
+			if hostIP == nil || hostIP.To4() == nil {
+				return nil, nil, fmt.Errorf("invalid hostIP %q", m.HostIP)
+			}
+			// an unspecified hostIP means all addresses
+			if !hostIP.IsUnspecified() {
+				dnat = append(dnat, "-d", hostIP.String()+"/32")
+			}
+		}
+		dnat = append(dnat, "--dport", hostPort, "-j", "DNAT", "--to-destination", net.JoinHostPort(podIP.String(), containerPort))
+		dnatRules = append(dnatRules, dnat)
+
+		for _, src := range []string{podIP.String(), "127.0.0.1"} {
+			snat := append([]string{"-p", proto}, comment...)
+			snatRules = append(snatRules, append(snat,
+				"-s", src+"/32", "-d", podIP.String()+"/32", "--dport", containerPort, "-j", "MASQUERADE",
+			))
+		}
+	}
+	return dnatRules, snatRules, nil
+}
+
+// containerIDs extracts the container IDs of network netName from the comments of the rules in `iptables -S` format.
+func containerIDs(rules []string, netName string) []string {
+	var ids []string
+	for _, rule := range rules {
+		if m := commentRegexp.FindStringSubmatch(rule); m != nil && m[1] == netName {
+			ids = append(ids, m[2])
+		}
+	}
+	return ids
+}
@@ -0,0 +1,57 @@
+package portmap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+func TestContainerRules(t *testing.T) {
+	podIP := net.ParseIP("10.244.1.2")
+	dnatRules, snatRules, err := containerRules("net1", "abc", podIP, []config.PortMapping{
+		{HostPort: 8080, ContainerPort: 80, Protocol: "TCP"},
+		{HostPort: 5353, ContainerPort: 53, Protocol: "udp", HostIP: "192.168.1.10"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"-p", "tcp", "-m", "comment", "--comment", "simple-cni-plugin: net1/abc", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.244.1.2:80"},
+		{"-p", "udp", "-m", "comment", "--comment", "simple-cni-plugin: net1/abc", "-d", "192.168.1.10/32", "--dport", "5353", "-j", "DNAT", "--to-destination", "10.244.1.2:53"},
+	}, dnatRules)
+	require.Len(t, snatRules, 4)
+	require.Equal(t, []string{"-p", "tcp", "-m", "comment", "--comment", "simple-cni-plugin: net1/abc", "-s", "10.244.1.2/32", "-d", "10.244.1.2/32", "--dport", "80", "-j", "MASQUERADE"}, snatRules[0])
+
+	_, _, err = containerRules("net1", "abc", podIP, []config.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}})
+	require.Error(t, err)
+	_, _, err = containerRules("net1", "abc", podIP, []config.PortMapping{{HostPort: 0, ContainerPort: 80}})
+	require.Error(t, err)
+}
+
+func TestContainerIDs(t *testing.T) {
+	rules := []string{
+		"-N SCNI-HOSTPORTS",
+		`-A SCNI-HOSTPORTS -m comment --comment "simple-cni-plugin: net1/abc" -j SCNI-DN-0123456789ABCDEF`,
+		`-A SCNI-HOSTPORTS -m comment --comment "simple-cni-plugin: net2/def" -j SCNI-DN-FEDCBA9876543210`,
+	}
+	require.Equal(t, []string{"abc"}, containerIDs(rules, "net1"))
+	require.Equal(t, []string{"def"}, containerIDs(rules, "net2"))
+
+	// the rules of a container chain whose jump rule is gone
+	rules = []string{
+		"-N SCNI-DN-0123456789ABCDEF",
+		`-A SCNI-DN-0123456789ABCDEF -p tcp -m comment --comment "simple-cni-plugin: net1/abc" -m tcp --dport 8080 -j DNAT --to-destination 10.244.1.2:80`,
+	}
+	require.Equal(t, []string{"abc"}, containerIDs(rules, "net1"))
+	require.Empty(t, containerIDs(rules, "net2"))
+}
+
+func TestContainerChains(t *testing.T) {
+	dnat, snat := containerChains("net1", "abc")
+	require.LessOrEqual(t, len(dnat), 28)
+	require.Equal(t, dnat[len(dnatChainPrefix):], snat[len(snatChainPrefix):])
+
+	other, _ := containerChains("net2", "abc")
+	require.NotEqual(t, dnat, other)
+}
@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 
 	"github.com/alexflint/go-filemutex"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
 )
 
 const (
@@ -18,6 +20,16 @@ type IP = string
 type containerNetInfo struct {
 	ID     string `json:"id"` // Container ID
 	IFName string `json:"if"`
+	HostIF string `json:"hostIf,omitempty"` // host-side veth
+	VLAN   int    `json:"vlan,omitempty"`   // VLAN of the host veth, whose pod route outlives the veth
+
+	// identity of the kubernetes pod, empty for other containers
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	PodUID       string `json:"podUid,omitempty"`
+
+	// bandwidth limits applied by the daemonset from the pod annotations, which override the runtimeConfig
+	Bandwidth *config.Bandwidth `json:"bandwidth,omitempty"`
 }
 
 type data struct {
@@ -63,19 +75,13 @@ func (s *Store) LoadData() error {
 	data := &data{}
 	raw, err := os.ReadFile(s.dataFile)
 	if err != nil {
-		if os.IsNotExist(err) {
-			f, err := os.Create(s.dataFile)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			_, err = f.Write([]byte("{}"))
-			if err != nil {
-				return err
-			}
+		if !os.IsNotExist(err) {
+			return err
 		}
-		return err
+		if err = os.WriteFile(s.dataFile, []byte("{}"), 0644); err != nil {
+			return err
+		}
+		raw = []byte("{}")
 	}
 	if err = json.Unmarshal(raw, data); err != nil {
 		return err
@@ -96,6 +102,86 @@ func (s *Store) GetIPByID(id string) (net.IP, bool) {
 	return nil, false
 }
 
+func (s *Store) GetHostIFByID(id string) (string, bool) {
+	for _, info := range s.data.IPs {
+		if info.ID == id {
+			return info.HostIF, info.HostIF != ""
+		}
+	}
+	return "", false
+}
+
+func (s *Store) GetHostIFByIP(ip net.IP) (string, bool) {
+	info, ok := s.data.IPs[ip.String()]
+	if !ok || info.HostIF == "" {
+		return "", false
+	}
+	return info.HostIF, true
+}
+
+func (s *Store) SetHostIF(id, hostIF string) error {
+	for ip, info := range s.data.IPs {
+		if info.ID == id {
+			info.HostIF = hostIF
+			s.data.IPs[ip] = info
+			return s.Store()
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetVLANByID(id string) (int, bool) {
+	for _, info := range s.data.IPs {
+		if info.ID == id {
+			return info.VLAN, info.VLAN != 0
+		}
+	}
+	return 0, false
+}
+
+func (s *Store) SetVLAN(id string, vlan int) error {
+	for ip, info := range s.data.IPs {
+		if info.ID == id {
+			info.VLAN = vlan
+			s.data.IPs[ip] = info
+			return s.Store()
+		}
+	}
+	return nil
+}
+
+func (s *Store) SetPod(id, namespace, name, uid string) error {
+	for ip, info := range s.data.IPs {
+		if info.ID == id {
+			info.PodNamespace = namespace
+			info.PodName = name
+			info.PodUID = uid
+			s.data.IPs[ip] = info
+			return s.Store()
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetBandwidthByID(id string) (*config.Bandwidth, bool) {
+	for _, info := range s.data.IPs {
+		if info.ID == id {
+			return info.Bandwidth, info.Bandwidth != nil
+		}
+	}
+	return nil, false
+}
+
+func (s *Store) SetBandwidthByIP(ip net.IP, bw *config.Bandwidth) error {
+	info, ok := s.data.IPs[ip.String()]
+	if !ok {
+		return nil
+	}
+	info.Bandwidth = bw
+	s.data.IPs[ip.String()] = info
+	return s.Store()
+}
+
 func (s *Store) Last() net.IP {
 	return net.ParseIP(s.data.Last)
 }
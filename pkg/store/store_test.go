@@ -0,0 +1,56 @@
+package store
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+func TestHostIF(t *testing.T) {
+	s, err := NewStore(t.TempDir(), "test")
+	require.NoError(t, err)
+	defer s.Close()
+
+	// the data file doesn't exist yet, it should be loaded as empty
+	require.NoError(t, s.LoadData())
+	_, ok := s.GetHostIFByID("container")
+	require.False(t, ok)
+
+	require.NoError(t, s.Add(net.ParseIP("10.244.1.2"), "container", "eth0"))
+	require.NoError(t, s.SetHostIF("container", "veth1234"))
+	require.NoError(t, s.SetVLAN("container", 100))
+
+	require.NoError(t, s.LoadData())
+	hostIF, ok := s.GetHostIFByID("container")
+	require.True(t, ok)
+	require.Equal(t, "veth1234", hostIF)
+	vlan, ok := s.GetVLANByID("container")
+	require.True(t, ok)
+	require.Equal(t, 100, vlan)
+
+	require.NoError(t, s.Del("container"))
+	_, ok = s.GetHostIFByID("container")
+	require.False(t, ok)
+}
+
+func TestBandwidth(t *testing.T) {
+	s, err := NewStore(t.TempDir(), "test")
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.LoadData())
+	ip := net.ParseIP("10.244.1.2")
+	require.NoError(t, s.Add(ip, "container", "eth0"))
+	_, ok := s.GetBandwidthByID("container")
+	require.False(t, ok)
+
+	bw := &config.Bandwidth{IngressRate: 1000000, IngressBurst: 2000000}
+	require.NoError(t, s.SetBandwidthByIP(ip, bw))
+	require.NoError(t, s.LoadData())
+	recorded, ok := s.GetBandwidthByID("container")
+	require.True(t, ok)
+	require.Equal(t, bw, recorded)
+}
@@ -0,0 +1,170 @@
+// Package tuning applies sysctls and interface settings to the container veth.
+// Everything here runs inside the container netns.
+package tuning
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/safchain/ethtool"
+	"github.com/vishvananda/netlink"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+var (
+	SysctlNotAllowedError   = errors.New("sysctl is not allowed")
+	SysctlMismatchError     = errors.New("sysctl mismatch")
+	TxQueueLenMismatchError = errors.New("txqueuelen mismatch")
+	OffloadMismatchError    = errors.New("tx checksum offload mismatch")
+)
+
+// safeSysctls only affect the container netns, the same set kubernetes considers safe.
+var safeSysctls = map[string]bool{
+	"net.ipv4.ip_local_port_range":        true,
+	"net.ipv4.ip_unprivileged_port_start": true,
+	"net.ipv4.ping_group_range":           true,
+	"net.ipv4.tcp_syncookies":             true,
+}
+
+// Validate rejects the sysctls of conf that aren't allowlisted for the container interface ifName.
+// Besides the safe sysctls, the per-interface sysctls of ifName, "all" and "default" are allowed.
+func Validate(ifName string, conf *config.TuningConf) error {
+	if conf == nil {
+		return nil
+	}
+	for key := range conf.Sysctl {
+		if !allowed(ifName, key) {
+			return fmt.Errorf("%w: %s", SysctlNotAllowedError, key)
+		}
+	}
+	if conf.TxQueueLen != nil && *conf.TxQueueLen < 0 {
+		return fmt.Errorf("invalid txQueueLen %d", *conf.TxQueueLen)
+	}
+	return nil
+}
+
+func allowed(ifName, key string) bool {
+	if strings.Contains(key, "/") || strings.Contains(key, "..") {
+		return false
+	}
+	if safeSysctls[key] {
+		return true
+	}
+	for _, family := range []string{"net.ipv4.", "net.ipv6."} {
+		for _, dev := range []string{ifName, "all", "default"} {
+			if strings.HasPrefix(key, family+"conf."+dev+".") {
+				return true
+			}
+		}
+		for _, dev := range []string{ifName, "default"} {
+			if strings.HasPrefix(key, family+"neigh."+dev+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Apply applies conf to the container interface link, it must be called in the container netns.
+func Apply(link netlink.Link, conf *config.TuningConf) error {
+	if conf == nil {
+		return nil
+	}
+	for key, value := range conf.Sysctl {
+		if _, err := sysctl.Sysctl(key, value); err != nil {
+			return fmt.Errorf("failed to set sysctl %s=%s: %v", key, value, err)
+		}
+	}
+	name := link.Attrs().Name
+	if conf.TxQueueLen != nil {
+		if err := netlink.LinkSetTxQLen(link, *conf.TxQueueLen); err != nil {
+			return fmt.Errorf("failed to set txqueuelen of %s: %v", name, err)
+		}
+	}
+	if conf.TxChecksumOffload != nil {
+		if err := setTxChecksum(name, *conf.TxChecksumOffload); err != nil {
+			return fmt.Errorf("failed to set tx checksum offload of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Check verifies that conf is applied to the container interface link, it must be called in the container netns.
+func Check(link netlink.Link, conf *config.TuningConf) error {
+	if conf == nil {
+		return nil
+	}
+	for key, value := range conf.Sysctl {
+		current, err := sysctl.Sysctl(key)
+		if err != nil {
+			return err
+		}
+		// multi-valued sysctls are read back separated by tabs
+		if strings.Join(strings.Fields(current), " ") != strings.Join(strings.Fields(value), " ") {
+			return fmt.Errorf("%w: %s is %q, expected %q", SysctlMismatchError, key, current, value)
+		}
+	}
+	name := link.Attrs().Name
+	if conf.TxQueueLen != nil && link.Attrs().TxQLen != *conf.TxQueueLen {
+		return fmt.Errorf("%w: %s has %d, expected %d", TxQueueLenMismatchError, name, link.Attrs().TxQLen, *conf.TxQueueLen)
+	}
+	if conf.TxChecksumOffload != nil {
+		on, err := txChecksum(name)
+		if err != nil {
+			return err
+		}
+		if on != *conf.TxChecksumOffload {
+			return fmt.Errorf("%w: %s is %t, expected %t", OffloadMismatchError, name, on, *conf.TxChecksumOffload)
+		}
+	}
+	return nil
+}
+
+// txChecksumPrefix is the prefix of the features `ethtool -K tx` toggles, one per kind of checksum
+const txChecksumPrefix = "tx-checksum-"
+
+// txChecksum reports whether any kind of tx checksum offload is on, as `ethtool -k` does.
+func txChecksum(ifName string) (bool, error) {
+	e, err := ethtool.NewEthtool()
+	if err != nil {
+		return false, err
+	}
+	defer e.Close()
+
+	features, err := e.Features(ifName)
+	if err != nil {
+		return false, err
+	}
+	for name, on := range features {
+		if strings.HasPrefix(name, txChecksumPrefix) && on {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func setTxChecksum(ifName string, on bool) error {
+	e, err := ethtool.NewEthtool()
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+
+	names, err := e.FeatureNames(ifName)
+	if err != nil {
+		return err
+	}
+	change := make(map[string]bool)
+	for name := range names {
+		if strings.HasPrefix(name, txChecksumPrefix) {
+			change[name] = on
+		}
+	}
+	if len(change) == 0 {
+		return fmt.Errorf("%s has no tx checksum offload", ifName)
+	}
+	return e.Change(ifName, change)
+}
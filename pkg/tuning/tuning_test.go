@@ -0,0 +1,28 @@
+package tuning
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mayooot/simple-cni-plugin/pkg/config"
+)
+
+func TestValidate(t *testing.T) {
+	for _, key := range []string{
+		"net.ipv4.conf.eth0.rp_filter",
+		"net.ipv4.conf.all.arp_notify",
+		"net.ipv6.neigh.eth0.base_reachable_time_ms",
+		"net.ipv4.ip_local_port_range",
+	} {
+		require.NoError(t, Validate("eth0", &config.TuningConf{Sysctl: map[string]string{key: "1"}}), key)
+	}
+	for _, key := range []string{
+		"net.ipv4.conf.eth1.rp_filter",
+		"net.ipv4.ip_forward",
+		"net.ipv4.conf.eth0.../../../kernel/panic",
+		"kernel.panic",
+	} {
+		require.ErrorIs(t, Validate("eth0", &config.TuningConf{Sysctl: map[string]string{key: "1"}}), SysctlNotAllowedError, key)
+	}
+}